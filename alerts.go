@@ -0,0 +1,133 @@
+package hello
+
+import (
+  "context"
+  "fmt"
+  "strconv"
+  "strings"
+  "sync"
+
+  "google.golang.org/appengine/log"
+)
+
+// alert is something the dashboard wants people to notice. Alerts are
+// shown at the top of the page and written to the App Engine log, where
+// log-based alerting can pick them up.
+type alert struct {
+  Name string
+  Message string
+  // state tells one firing of an alert from the next, e.g. the month a
+  // budget is over, as the message changes with every page view.
+  state string
+}
+
+// firingAlerts are the alerts this instance last saw firing.
+var firingAlerts = struct {
+  sync.Mutex
+  keys map[string]bool
+}{keys: map[string]bool{}}
+
+// logAlerts logs alerts when they start firing, and again when they stop,
+// rather than on every page view. Each instance keeps its own record, so
+// an alert is logged once per instance which sees it.
+func logAlerts(ctx context.Context, alerts []alert) {
+  firingAlerts.Lock()
+  defer firingAlerts.Unlock()
+
+  keys := map[string]bool{}
+  for _, a := range alerts {
+    k := a.Name + "\x00" + a.state
+    keys[k] = true
+    if !firingAlerts.keys[k] {
+      log.Warningf(ctx, "alert %s: %s", a.Name, a.Message)
+    }
+  }
+  for k := range firingAlerts.keys {
+    if !keys[k] {
+      log.Infof(ctx, "alert %s cleared", strings.SplitN(k, "\x00", 2)[0])
+    }
+  }
+  firingAlerts.keys = keys
+}
+
+// budgetAlert fires when the month's spend reaches Amount. Basis picks
+// whether that's the spend so far ("spent") or the forecast month-end
+// total ("projected").
+type budgetAlert struct {
+  Basis string
+  Amount money
+}
+
+// parseBudgetAlerts reads budget alerts from a comma-separated list of
+// basis:amount pairs, e.g. "spent:500,projected:1000", as found in the
+// BUDGET_ALERTS environment variable.
+func parseBudgetAlerts(s string) ([]budgetAlert, error) {
+  var alerts []budgetAlert
+  for _, f := range strings.Split(s, ",") {
+    f = strings.TrimSpace(f)
+    if f == "" {
+      continue
+    }
+    parts := strings.SplitN(f, ":", 2)
+    if len(parts) != 2 {
+      return nil, fmt.Errorf("budget alert %q: expected basis:amount", f)
+    }
+    basis := parts[0]
+    if basis != "spent" && basis != "projected" {
+      return nil, fmt.Errorf("budget alert %q: unknown basis %q", f, basis)
+    }
+    amount, err := strconv.ParseFloat(parts[1], 64)
+    if err != nil {
+      return nil, fmt.Errorf("budget alert %q: %s", f, err)
+    }
+    alerts = append(alerts, budgetAlert{basis, usd(amount)})
+  }
+  return alerts, nil
+}
+
+// checkBudgets returns an alert for every budget the forecast has reached.
+func checkBudgets(budgets []budgetAlert, f forecastResult) []alert {
+  var alerts []alert
+  for _, b := range budgets {
+    value := f.SpentSoFar
+    if b.Basis == "projected" {
+      value = f.Projected
+    }
+    if value.Cmp(b.Amount) >= 0 {
+      alerts = append(alerts, alert{
+        Name: "budget-" + b.Basis,
+        Message: fmt.Sprintf("%s spend for %s is %s %s, over the budget of %s %s",
+          b.Basis, f.Month, value, value.Currency(), b.Amount, b.Amount.Currency()),
+        state: fmt.Sprint(f.Month),
+      })
+    }
+  }
+  return alerts
+}
+
+// checkRegressions returns an alert for every image version flagged as a
+// regression.
+func checkRegressions(regs []regression) []alert {
+  var alerts []alert
+  for _, r := range regs {
+    if !r.Flagged() {
+      continue
+    }
+    var what []string
+    if r.CostRegressed {
+      what = append(what, fmt.Sprintf("median cost %s to %s USD (x%.2f, p=%.3g)",
+        r.FromCost, r.ToCost, r.CostRatio, r.CostP))
+    }
+    if r.DurationRegressed {
+      what = append(what, fmt.Sprintf("median duration %s to %s (x%.2f, p=%.3g)",
+        r.FromDuration, r.ToDuration, r.DurationRatio, r.DurationP))
+    }
+    alerts = append(alerts, alert{
+      Name: "regression-" + r.Pipeline,
+      Message: fmt.Sprintf("%s: %s %s to %s went from %s", r.Pipeline, r.Image, r.From, r.To,
+        strings.Join(what, " and ")),
+      state: r.Image + " " + r.From + " " + r.To,
+    })
+  }
+  return alerts
+}
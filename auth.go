@@ -0,0 +1,611 @@
+package hello
+
+import (
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "math/big"
+  "net/http"
+  "net/url"
+  "os"
+  "strings"
+  "sync"
+  "time"
+
+  "google.golang.org/appengine"
+  "google.golang.org/appengine/user"
+)
+
+// role is what a user is allowed to see. Each role can see everything
+// the roles before it can.
+type role int
+
+const (
+  roleNone role = iota
+  roleViewer
+  roleFinance
+  roleAdmin
+)
+
+var roleNames = []string{"none", "viewer", "finance", "admin"}
+
+func (r role) String() string {
+  return roleNames[r]
+}
+
+func parseRole(s string) (role, error) {
+  for i, name := range roleNames {
+    if name == s {
+      return role(i), nil
+    }
+  }
+  return roleNone, fmt.Errorf("unknown role %q", s)
+}
+
+// authUser is the person making a request.
+type authUser struct {
+  Email string
+  Role role
+}
+
+// Authentication modes. "appengine" and "iap" are for hosted deployments,
+// "oidc" and "basic" for running standalone, and "none" lets everyone in
+// as an admin, which is only meant for local development.
+const (
+  authAppEngine = "appengine"
+  authIAP = "iap"
+  authOIDC = "oidc"
+  authBasic = "basic"
+  authNone = "none"
+)
+
+// authConfig is read from the environment:
+//
+//   AUTH_MODE       one of the modes above, "appengine" by default
+//   AUTH_ROLES      email=role pairs, e.g. "alice@example.org=admin,*@example.org=viewer"
+//   ROUTE_ROLES     path=role pairs overriding the role a view needs, e.g. "/storage=admin",
+//                   or "/metrics=none" to serve a view without logging in
+//   BASIC_USERS     user=sha256-hex-of-password pairs, for basic mode
+//   OIDC_ISSUER     e.g. "https://accounts.google.com", for oidc mode
+//   OIDC_CLIENT_ID  the audience ID tokens must be issued for, for oidc mode
+//   OIDC_CLIENT_SECRET  the client's secret, for oidc mode, to log people in
+//                   with the authorization code flow
+//   OIDC_REDIRECT_URL   where the issuer sends people back to, ending in
+//                   /oidc/callback; by default the request's host's /oidc/callback
+//
+// In oidc mode without OIDC_CLIENT_SECRET the app doesn't log people in
+// itself: something in front of it, like an authenticating proxy, must
+// pass an ID token in an "Authorization: Bearer" header or an "id_token"
+// cookie. Either way, tokens are checked for the issuer and client ID.
+type authConfig struct {
+  Mode string
+  Roles map[string]role
+  RouteRoles map[string]role
+  BasicUsers map[string]string
+  OIDCIssuer string
+  OIDCClientID string
+  OIDCClientSecret string
+  OIDCRedirectURL string
+}
+
+var authConf authConfig
+
+func init() {
+  var err error
+  authConf, err = loadAuthConfig()
+  if err != nil {
+    panic(err)
+  }
+}
+
+func loadAuthConfig() (authConfig, error) {
+  c := authConfig{
+    Mode: os.Getenv("AUTH_MODE"),
+    OIDCIssuer: strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+    OIDCClientID: os.Getenv("OIDC_CLIENT_ID"),
+    OIDCClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+    OIDCRedirectURL: os.Getenv("OIDC_REDIRECT_URL"),
+  }
+  if c.Mode == "" {
+    c.Mode = authAppEngine
+  }
+
+  var err error
+  c.Roles, err = parseRoles(os.Getenv("AUTH_ROLES"))
+  if err != nil {
+    return c, err
+  }
+  c.RouteRoles, err = parseRoles(os.Getenv("ROUTE_ROLES"))
+  if err != nil {
+    return c, err
+  }
+  c.BasicUsers, err = parsePairs(os.Getenv("BASIC_USERS"))
+  if err != nil {
+    return c, err
+  }
+
+  switch c.Mode {
+  case authAppEngine, authIAP, authBasic, authNone:
+  case authOIDC:
+    if c.OIDCIssuer == "" || c.OIDCClientID == "" {
+      return c, errors.New("oidc auth needs OIDC_ISSUER and OIDC_CLIENT_ID")
+    }
+  default:
+    return c, fmt.Errorf("unknown AUTH_MODE %q", c.Mode)
+  }
+  return c, nil
+}
+
+func parseRoles(s string) (map[string]role, error) {
+  pairs, err := parsePairs(s)
+  if err != nil {
+    return nil, err
+  }
+  roles := map[string]role{}
+  for k, v := range pairs {
+    r, err := parseRole(v)
+    if err != nil {
+      return nil, fmt.Errorf("%s: %s", k, err)
+    }
+    roles[k] = r
+  }
+  return roles, nil
+}
+
+// roleFor looks up a user's role by exact email, then by "*@domain",
+// then by "*".
+func (c authConfig) roleFor(email string) role {
+  if r, ok := c.Roles[email]; ok {
+    return r
+  }
+  if i := strings.LastIndex(email, "@"); i != -1 {
+    if r, ok := c.Roles["*" + email[i:]]; ok {
+      return r
+    }
+  }
+  return c.Roles["*"]
+}
+
+// routeRole returns the role needed to see a path.
+func (c authConfig) routeRole(path string, def role) role {
+  if r, ok := c.RouteRoles[path]; ok {
+    return r
+  }
+  return def
+}
+
+// requireRole wraps a view so it's only served to users with at least
+// the given role, unless ROUTE_ROLES says otherwise.
+func requireRole(min role, h http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    need := authConf.routeRole(r.URL.Path, min)
+    // Routes opened up with the "none" role, e.g. /metrics for a
+    // Prometheus scraper, don't need a login at all.
+    if need == roleNone {
+      h(w, r)
+      return
+    }
+    u, ok := authenticate(w, r)
+    if !ok {
+      return
+    }
+    if u.Role < need {
+      http.Error(w, fmt.Sprintf("%s doesn't have access to this page", u.Email), http.StatusForbidden)
+      return
+    }
+    h(w, r)
+  }
+}
+
+// currentUser returns the user making the request, if they could be
+// authenticated.
+func currentUser(r *http.Request) (authUser, error) {
+  switch authConf.Mode {
+  case authNone:
+    return authUser{Email: "anonymous", Role: roleAdmin}, nil
+
+  case authAppEngine:
+    ctx := appengine.NewContext(r)
+    u := user.Current(ctx)
+    if u == nil {
+      return authUser{}, errNotLoggedIn
+    }
+    au := authUser{Email: u.Email, Role: authConf.roleFor(u.Email)}
+    if u.Admin {
+      au.Role = roleAdmin
+    }
+    return au, nil
+
+  case authIAP:
+    // IAP strips this header from incoming requests and sets it itself,
+    // so it can be trusted as long as the app is only reachable through IAP.
+    h := r.Header.Get("X-Goog-Authenticated-User-Email")
+    if h == "" {
+      return authUser{}, errNotLoggedIn
+    }
+    email := strings.TrimPrefix(h, "accounts.google.com:")
+    return authUser{Email: email, Role: authConf.roleFor(email)}, nil
+
+  case authBasic:
+    name, pass, ok := r.BasicAuth()
+    if !ok {
+      return authUser{}, errNotLoggedIn
+    }
+    want, ok := authConf.BasicUsers[name]
+    sum := sha256.Sum256([]byte(pass))
+    got := hex.EncodeToString(sum[:])
+    if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(strings.ToLower(want))) != 1 {
+      return authUser{}, errNotLoggedIn
+    }
+    return authUser{Email: name, Role: authConf.roleFor(name)}, nil
+
+  case authOIDC:
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if token == "" {
+      if c, err := r.Cookie("id_token"); err == nil {
+        token = c.Value
+      }
+    }
+    if token == "" {
+      return authUser{}, errNotLoggedIn
+    }
+    email, err := oidcVerifier.verify(token)
+    if err != nil {
+      return authUser{}, err
+    }
+    return authUser{Email: email, Role: authConf.roleFor(email)}, nil
+  }
+  return authUser{}, fmt.Errorf("unknown AUTH_MODE %q", authConf.Mode)
+}
+
+var errNotLoggedIn = errors.New("not logged in")
+
+// authenticate finds the current user, or asks them to log in.
+func authenticate(w http.ResponseWriter, r *http.Request) (authUser, bool) {
+  u, err := currentUser(r)
+  if err == nil {
+    return u, true
+  }
+
+  switch authConf.Mode {
+  case authAppEngine:
+    ctx := appengine.NewContext(r)
+    url, err := user.LoginURL(ctx, r.URL.String())
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return u, false
+    }
+    http.Redirect(w, r, url, http.StatusFound)
+  case authBasic:
+    w.Header().Set("WWW-Authenticate", `Basic realm="pipelines dashboard"`)
+    http.Error(w, err.Error(), http.StatusUnauthorized)
+  case authOIDC:
+    // Browsers are sent to log in; API clients passing their own
+    // token are told it wasn't accepted.
+    if authConf.OIDCClientSecret == "" || r.Header.Get("Authorization") != "" || r.Method != http.MethodGet {
+      http.Error(w, err.Error(), http.StatusUnauthorized)
+      return u, false
+    }
+    if err := oidcLogin(w, r); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+  default:
+    http.Error(w, err.Error(), http.StatusUnauthorized)
+  }
+  return u, false
+}
+
+// oidcKeys verifies RS256-signed ID tokens against the issuer's published
+// keys, which are fetched through OpenID Connect discovery and cached.
+type oidcKeys struct {
+  mu sync.Mutex
+  keys map[string]*rsa.PublicKey
+  fetched time.Time
+  // tried is when the keys were last fetched, whether or not it worked.
+  tried time.Time
+}
+
+var oidcVerifier = &oidcKeys{}
+
+const (
+  oidcKeyTTL = time.Hour
+  // oidcKeyRetry is how often the keys can be refetched, so tokens with
+  // made-up key IDs can't make every request fetch them.
+  oidcKeyRetry = time.Minute
+)
+
+func (o *oidcKeys) verify(token string) (string, error) {
+  parts := strings.Split(token, ".")
+  if len(parts) != 3 {
+    return "", errors.New("malformed ID token")
+  }
+
+  var header struct {
+    Alg string
+    Kid string
+  }
+  if err := decodeJWTPart(parts[0], &header); err != nil {
+    return "", err
+  }
+  if header.Alg != "RS256" {
+    return "", fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+  }
+
+  key, err := o.key(header.Kid)
+  if err != nil {
+    return "", err
+  }
+  sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+  if err != nil {
+    return "", errors.New("malformed ID token signature")
+  }
+  digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+  if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+    return "", errors.New("invalid ID token signature")
+  }
+
+  var claims struct {
+    Iss string
+    Aud interface{}
+    Exp int64
+    Email string
+    EmailVerified *bool `json:"email_verified"`
+  }
+  if err := decodeJWTPart(parts[1], &claims); err != nil {
+    return "", err
+  }
+  if claims.Iss != authConf.OIDCIssuer {
+    return "", fmt.Errorf("ID token from unexpected issuer %q", claims.Iss)
+  }
+  if !audienceContains(claims.Aud, authConf.OIDCClientID) {
+    return "", errors.New("ID token issued for another client")
+  }
+  if time.Now().Unix() > claims.Exp {
+    return "", errors.New("ID token expired")
+  }
+  if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+    return "", errors.New("ID token has no verified email")
+  }
+  return claims.Email, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+  switch a := aud.(type) {
+  case string:
+    return a == clientID
+  case []interface{}:
+    for _, v := range a {
+      if v == clientID {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+  b, err := base64.RawURLEncoding.DecodeString(part)
+  if err != nil {
+    return errors.New("malformed ID token")
+  }
+  return json.Unmarshal(b, v)
+}
+
+// key returns the issuer's key with the given ID, refetching the keys when
+// they're stale or the ID is new, since issuers rotate keys, but no more
+// than once every oidcKeyRetry.
+func (o *oidcKeys) key(kid string) (*rsa.PublicKey, error) {
+  o.mu.Lock()
+  defer o.mu.Unlock()
+
+  if k, ok := o.keys[kid]; ok && time.Since(o.fetched) < oidcKeyTTL {
+    return k, nil
+  }
+  if time.Since(o.tried) >= oidcKeyRetry {
+    o.tried = time.Now()
+    keys, err := fetchOIDCKeys(authConf.OIDCIssuer)
+    if err != nil {
+      return nil, err
+    }
+    o.keys = keys
+    o.fetched = o.tried
+  }
+
+  k, ok := o.keys[kid]
+  if !ok {
+    return nil, fmt.Errorf("unknown ID token key %q", kid)
+  }
+  if time.Since(o.fetched) >= oidcKeyTTL {
+    return nil, errors.New("ID token keys are out of date")
+  }
+  return k, nil
+}
+
+// oidcDiscovery is the part of an issuer's OpenID Connect configuration
+// the app uses.
+type oidcDiscovery struct {
+  AuthorizationEndpoint string `json:"authorization_endpoint"`
+  TokenEndpoint string `json:"token_endpoint"`
+  JWKSURI string `json:"jwks_uri"`
+}
+
+func discoverOIDC(issuer string) (oidcDiscovery, error) {
+  var d oidcDiscovery
+  err := getJSON(issuer + "/.well-known/openid-configuration", &d)
+  return d, err
+}
+
+func fetchOIDCKeys(issuer string) (map[string]*rsa.PublicKey, error) {
+  discovery, err := discoverOIDC(issuer)
+  if err != nil {
+    return nil, err
+  }
+
+  var jwks struct {
+    Keys []struct {
+      Kid string
+      Kty string
+      N string
+      E string
+    }
+  }
+  if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+    return nil, err
+  }
+
+  keys := map[string]*rsa.PublicKey{}
+  for _, k := range jwks.Keys {
+    if k.Kty != "RSA" {
+      continue
+    }
+    n, err := base64.RawURLEncoding.DecodeString(k.N)
+    if err != nil {
+      continue
+    }
+    e, err := base64.RawURLEncoding.DecodeString(k.E)
+    if err != nil {
+      continue
+    }
+    keys[k.Kid] = &rsa.PublicKey{
+      N: new(big.Int).SetBytes(n),
+      E: int(new(big.Int).SetBytes(e).Int64()),
+    }
+  }
+  return keys, nil
+}
+
+func getJSON(url string, v interface{}) error {
+  resp, err := http.Get(url)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("GET %s: %s", url, resp.Status)
+  }
+  return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func init() {
+  http.HandleFunc("/oidc/callback", oidcCallbackHandler)
+}
+
+// isHTTPS reports whether a browser made a request over HTTPS, either to
+// the app or to the front end which forwarded it, like App Engine's or IAP's.
+func isHTTPS(r *http.Request) bool {
+  return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// oidcRedirectURL is where the issuer sends people back to after they
+// log in.
+func oidcRedirectURL(r *http.Request) string {
+  if authConf.OIDCRedirectURL != "" {
+    return authConf.OIDCRedirectURL
+  }
+  scheme := "http"
+  if isHTTPS(r) {
+    scheme = "https"
+  }
+  return scheme + "://" + r.Host + "/oidc/callback"
+}
+
+// oidcLogin sends a browser to the issuer to log in with the authorization
+// code flow. A random state, remembered in a cookie with the page to come
+// back to, ties the callback to this browser.
+func oidcLogin(w http.ResponseWriter, r *http.Request) error {
+  d, err := discoverOIDC(authConf.OIDCIssuer)
+  if err != nil {
+    return err
+  }
+  b := make([]byte, 16)
+  if _, err := rand.Read(b); err != nil {
+    return err
+  }
+  state := hex.EncodeToString(b)
+  http.SetCookie(w, &http.Cookie{Name: "oidc_state", Value: state + "|" + r.URL.RequestURI(),
+    Path: "/oidc/callback", MaxAge: 10 * 60, HttpOnly: true, Secure: isHTTPS(r)})
+
+  q := url.Values{}
+  q.Set("response_type", "code")
+  q.Set("client_id", authConf.OIDCClientID)
+  q.Set("redirect_uri", oidcRedirectURL(r))
+  q.Set("scope", "openid email")
+  q.Set("state", state)
+  http.Redirect(w, r, d.AuthorizationEndpoint + "?" + q.Encode(), http.StatusFound)
+  return nil
+}
+
+// oidcCallbackHandler exchanges the authorization code the issuer sends
+// back for an ID token, checks it like any other, and keeps it in the
+// "id_token" cookie.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+  if authConf.Mode != authOIDC || authConf.OIDCClientSecret == "" {
+    http.NotFound(w, r)
+    return
+  }
+  c, err := r.Cookie("oidc_state")
+  if err != nil {
+    http.Error(w, "login expired, try again", http.StatusBadRequest)
+    return
+  }
+  parts := strings.SplitN(c.Value, "|", 2)
+  state := r.URL.Query().Get("state")
+  if len(parts) != 2 || state == "" || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+    http.Error(w, "login state doesn't match, try again", http.StatusBadRequest)
+    return
+  }
+  // Only come back to a page of this app.
+  back := parts[1]
+  if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+    back = "/"
+  }
+  if e := r.URL.Query().Get("error"); e != "" {
+    http.Error(w, "login failed: " + e, http.StatusUnauthorized)
+    return
+  }
+
+  d, err := discoverOIDC(authConf.OIDCIssuer)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  resp, err := http.PostForm(d.TokenEndpoint, url.Values{
+    "grant_type": {"authorization_code"},
+    "code": {r.URL.Query().Get("code")},
+    "redirect_uri": {oidcRedirectURL(r)},
+    "client_id": {authConf.OIDCClientID},
+    "client_secret": {authConf.OIDCClientSecret},
+  })
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadGateway)
+    return
+  }
+  defer resp.Body.Close()
+  var tok struct {
+    IDToken string `json:"id_token"`
+  }
+  if resp.StatusCode != http.StatusOK {
+    http.Error(w, "token exchange failed: " + resp.Status, http.StatusBadGateway)
+    return
+  }
+  if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || tok.IDToken == "" {
+    http.Error(w, "token exchange returned no ID token", http.StatusBadGateway)
+    return
+  }
+  if _, err := oidcVerifier.verify(tok.IDToken); err != nil {
+    http.Error(w, err.Error(), http.StatusUnauthorized)
+    return
+  }
+
+  http.SetCookie(w, &http.Cookie{Name: "oidc_state", Path: "/oidc/callback", MaxAge: -1})
+  http.SetCookie(w, &http.Cookie{Name: "id_token", Value: tok.IDToken, Path: "/",
+    HttpOnly: true, Secure: isHTTPS(r)})
+  http.Redirect(w, r, back, http.StatusFound)
+}
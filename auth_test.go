@@ -0,0 +1,273 @@
+package hello
+
+import (
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+)
+
+// fakeIssuer is an OpenID Connect issuer publishing one RSA key, "k1",
+// which counts how often its keys are fetched.
+type fakeIssuer struct {
+  *httptest.Server
+  key *rsa.PrivateKey
+  jwksFetches int
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  iss := &fakeIssuer{key: key}
+  iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Path {
+    case "/.well-known/openid-configuration":
+      json.NewEncoder(w).Encode(map[string]string{
+        "authorization_endpoint": iss.URL + "/auth",
+        "token_endpoint": iss.URL + "/token",
+        "jwks_uri": iss.URL + "/jwks",
+      })
+    case "/jwks":
+      iss.jwksFetches++
+      json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+        "kid": "k1",
+        "kty": "RSA",
+        "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+        "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+      }}})
+    default:
+      http.NotFound(w, r)
+    }
+  }))
+  return iss
+}
+
+// sign makes an RS256 ID token with the given header and claims.
+func sign(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+  enc := func(v interface{}) string {
+    b, err := json.Marshal(v)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+  }
+  signed := enc(header) + "." + enc(claims)
+  digest := sha256.Sum256([]byte(signed))
+  sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+  if err != nil {
+    t.Fatal(err)
+  }
+  return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// withAuthConfig sets authConf for a test and returns a function which
+// puts the old one back.
+func withAuthConfig(c authConfig) func() {
+  old := authConf
+  authConf = c
+  return func() { authConf = old }
+}
+
+func TestOIDCVerify(t *testing.T) {
+  iss := newFakeIssuer(t)
+  defer iss.Close()
+  defer withAuthConfig(authConfig{Mode: authOIDC, OIDCIssuer: iss.URL, OIDCClientID: "dashboard"})()
+
+  other, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  header := map[string]interface{}{"alg": "RS256", "kid": "k1"}
+  claims := func(change func(map[string]interface{})) map[string]interface{} {
+    c := map[string]interface{}{
+      "iss": iss.URL,
+      "aud": "dashboard",
+      "exp": time.Now().Add(time.Hour).Unix(),
+      "email": "alice@example.org",
+      "email_verified": true,
+    }
+    if change != nil {
+      change(c)
+    }
+    return c
+  }
+
+  valid := sign(t, iss.key, header, claims(nil))
+  parts := strings.Split(valid, ".")
+  for _, c := range []struct {
+    name string
+    token string
+    ok bool
+  }{
+    {"valid", valid, true},
+    {"audience list", sign(t, iss.key, header, claims(func(c map[string]interface{}) {
+      c["aud"] = []string{"other", "dashboard"}
+    })), true},
+    {"other issuer", sign(t, iss.key, header, claims(func(c map[string]interface{}) {
+      c["iss"] = "https://evil.example.org"
+    })), false},
+    {"other audience", sign(t, iss.key, header, claims(func(c map[string]interface{}) {
+      c["aud"] = "someone-else"
+    })), false},
+    {"expired", sign(t, iss.key, header, claims(func(c map[string]interface{}) {
+      c["exp"] = time.Now().Add(-time.Minute).Unix()
+    })), false},
+    {"unverified email", sign(t, iss.key, header, claims(func(c map[string]interface{}) {
+      c["email_verified"] = false
+    })), false},
+    {"no email", sign(t, iss.key, header, claims(func(c map[string]interface{}) {
+      delete(c, "email")
+    })), false},
+    {"signed with another key", sign(t, other, header, claims(nil)), false},
+    {"claims changed after signing", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(
+      `{"iss":"` + iss.URL + `","aud":"dashboard","exp":9999999999,"email":"admin@example.org"}`)) + "." + parts[2], false},
+    {"unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + ".", false},
+    {"HS256", sign(t, iss.key, map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims(nil)), false},
+    {"malformed", "not-a-token", false},
+  } {
+    email, err := (&oidcKeys{}).verify(c.token)
+    if c.ok && (err != nil || email != "alice@example.org") {
+      t.Errorf("%s: %q, %v; want alice@example.org", c.name, email, err)
+    }
+    if !c.ok && err == nil {
+      t.Errorf("%s: accepted as %q", c.name, email)
+    }
+  }
+}
+
+func TestOIDCKeyRefetchLimit(t *testing.T) {
+  iss := newFakeIssuer(t)
+  defer iss.Close()
+  defer withAuthConfig(authConfig{Mode: authOIDC, OIDCIssuer: iss.URL, OIDCClientID: "dashboard"})()
+
+  keys := &oidcKeys{}
+  claims := map[string]interface{}{"iss": iss.URL, "aud": "dashboard", "exp": time.Now().Add(time.Hour).Unix(), "email": "a@example.org"}
+  for i := 0; i < 5; i++ {
+    forged := sign(t, iss.key, map[string]interface{}{"alg": "RS256", "kid": "made-up"}, claims)
+    if _, err := keys.verify(forged); err == nil {
+      t.Fatal("token with an unknown key ID accepted")
+    }
+  }
+  if iss.jwksFetches != 1 {
+    t.Errorf("unknown key IDs fetched the keys %d times, want 1", iss.jwksFetches)
+  }
+  if _, err := keys.verify(sign(t, iss.key, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims)); err != nil {
+    t.Errorf("known key after unknown ones: %s", err)
+  }
+
+  // Once the limit has passed, a new key ID fetches the keys again.
+  keys.tried = time.Now().Add(-oidcKeyRetry)
+  keys.verify(sign(t, iss.key, map[string]interface{}{"alg": "RS256", "kid": "rotated"}, claims))
+  if iss.jwksFetches != 2 {
+    t.Errorf("keys fetched %d times after the limit passed, want 2", iss.jwksFetches)
+  }
+}
+
+func TestOIDCLoginCookiesBehindProxy(t *testing.T) {
+  iss := newFakeIssuer(t)
+  defer iss.Close()
+  defer withAuthConfig(authConfig{Mode: authOIDC, OIDCIssuer: iss.URL, OIDCClientID: "dashboard",
+    OIDCClientSecret: "secret", Roles: map[string]role{"*": roleViewer}})()
+
+  for _, proto := range []string{"", "https"} {
+    r := httptest.NewRequest("GET", "/whatif?machine=n1", nil)
+    if proto != "" {
+      r.Header.Set("X-Forwarded-Proto", proto)
+    }
+    w := httptest.NewRecorder()
+    requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {})(w, r)
+    loc, err := url.Parse(w.Header().Get("Location"))
+    if w.Code != http.StatusFound || err != nil || loc.Path != "/auth" {
+      t.Fatalf("%q: %d, %q", proto, w.Code, w.Header().Get("Location"))
+    }
+    cookies := w.Result().Cookies()
+    if len(cookies) != 1 || cookies[0].Name != "oidc_state" || cookies[0].Secure != (proto == "https") {
+      t.Errorf("%q: cookies %+v", proto, cookies)
+    }
+    if want := proto + "://example.com/oidc/callback"; proto != "" && loc.Query().Get("redirect_uri") != want {
+      t.Errorf("%q: redirect_uri %q, want %q", proto, loc.Query().Get("redirect_uri"), want)
+    }
+  }
+}
+
+func TestBasicAuth(t *testing.T) {
+  sum := sha256.Sum256([]byte("s3cret"))
+  hash := hex.EncodeToString(sum[:])
+  defer withAuthConfig(authConfig{
+    Mode: authBasic,
+    BasicUsers: map[string]string{"alice": hash, "bob": strings.ToUpper(hash)},
+    Roles: map[string]role{"alice": roleFinance},
+  })()
+
+  for _, c := range []struct {
+    user, pass string
+    set bool
+    ok bool
+    role role
+  }{
+    {"alice", "s3cret", true, true, roleFinance},
+    {"bob", "s3cret", true, true, roleNone},
+    {"alice", "wrong", true, false, roleNone},
+    {"alice", "", true, false, roleNone},
+    {"carol", "s3cret", true, false, roleNone},
+    {"", "", false, false, roleNone},
+  } {
+    r := httptest.NewRequest("GET", "/", nil)
+    if c.set {
+      r.SetBasicAuth(c.user, c.pass)
+    }
+    u, err := currentUser(r)
+    if (err == nil) != c.ok || u.Role != c.role {
+      t.Errorf("%s/%s: %+v, %v", c.user, c.pass, u, err)
+    }
+  }
+}
+
+func TestRequireRole(t *testing.T) {
+  sum := sha256.Sum256([]byte("pw"))
+  hash := hex.EncodeToString(sum[:])
+  defer withAuthConfig(authConfig{
+    Mode: authBasic,
+    BasicUsers: map[string]string{"viewer": hash, "finance": hash, "nobody": hash},
+    Roles: map[string]role{"viewer": roleViewer, "finance": roleFinance},
+    RouteRoles: map[string]role{"/metrics": roleNone, "/storage": roleAdmin},
+  })()
+
+  for _, c := range []struct {
+    path string
+    min role
+    user string
+    code int
+  }{
+    {"/", roleViewer, "", http.StatusUnauthorized},
+    {"/", roleViewer, "nobody", http.StatusForbidden},
+    {"/", roleViewer, "viewer", http.StatusOK},
+    {"/reconcile", roleFinance, "viewer", http.StatusForbidden},
+    {"/reconcile", roleFinance, "finance", http.StatusOK},
+    // ROUTE_ROLES opens up and closes down views.
+    {"/metrics", roleViewer, "", http.StatusOK},
+    {"/storage", roleFinance, "finance", http.StatusForbidden},
+  } {
+    r := httptest.NewRequest("GET", c.path, nil)
+    if c.user != "" {
+      r.SetBasicAuth(c.user, "pw")
+    }
+    w := httptest.NewRecorder()
+    requireRole(c.min, func(w http.ResponseWriter, r *http.Request) {})(w, r)
+    if w.Code != c.code {
+      t.Errorf("%s as %q: %d, want %d", c.path, c.user, w.Code, c.code)
+    }
+  }
+}
@@ -0,0 +1,559 @@
+package hello
+
+import (
+  "bufio"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/reconcile", requireRole(roleFinance, reconcileHandler))
+}
+
+// reconcileHighlights is how many of the biggest differences are highlighted.
+const reconcileHighlights = 5
+
+// billingItem is a line item of the Cloud Billing export.
+type billingItem struct {
+  Service string
+  SKU string
+  Project string
+  Start time.Time
+  End time.Time
+  Labels map[string]string
+  // Cost is what was billed net of credits, such as sustained use
+  // discounts and free tier, which Credits holds the sum of.
+  Cost money
+  Credits money
+  Currency string
+}
+
+// loadBillingExport reads the billing export files in BILLING_EXPORT,
+// a comma-separated list of paths or globs. The export is a BigQuery
+// table, dumped as newline-delimited JSON, or, since CSV can't hold the
+// nested columns, as CSV from a query which flattens them.
+func loadBillingExport(patterns string) ([]billingItem, error) {
+  var items []billingItem
+  for _, pattern := range strings.Split(patterns, ",") {
+    pattern = strings.TrimSpace(pattern)
+    if pattern == "" {
+      continue
+    }
+    paths, err := filepath.Glob(pattern)
+    if err != nil {
+      return nil, err
+    }
+    for _, p := range paths {
+      f, err := os.Open(p)
+      if err != nil {
+        return nil, err
+      }
+      var more []billingItem
+      if strings.HasSuffix(p, ".csv") {
+        more, err = readBillingCSV(f)
+      } else {
+        more, err = readBillingNDJSON(f)
+      }
+      f.Close()
+      if err != nil {
+        return nil, fmt.Errorf("billing export %s: %s", p, err)
+      }
+      items = append(items, more...)
+    }
+  }
+  return items, nil
+}
+
+func readBillingNDJSON(r io.Reader) ([]billingItem, error) {
+  var items []billingItem
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+  for scanner.Scan() {
+    if strings.TrimSpace(scanner.Text()) == "" {
+      continue
+    }
+    var line struct {
+      Service struct {
+        Description string `json:"description"`
+      } `json:"service"`
+      SKU struct {
+        Description string `json:"description"`
+      } `json:"sku"`
+      Project struct {
+        ID string `json:"id"`
+      } `json:"project"`
+      UsageStartTime string `json:"usage_start_time"`
+      UsageEndTime string `json:"usage_end_time"`
+      Labels []struct {
+        Key string `json:"key"`
+        Value string `json:"value"`
+      } `json:"labels"`
+      Cost json.Number `json:"cost"`
+      Currency string `json:"currency"`
+      Credits []struct {
+        Amount json.Number `json:"amount"`
+      } `json:"credits"`
+    }
+    if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+      return nil, err
+    }
+
+    item := billingItem{
+      Service: line.Service.Description,
+      SKU: line.SKU.Description,
+      Project: line.Project.ID,
+      Start: parseBillingTime(line.UsageStartTime),
+      End: parseBillingTime(line.UsageEndTime),
+      Labels: map[string]string{},
+      Currency: line.Currency,
+    }
+    cost, _ := line.Cost.Float64()
+    credits := 0.0
+    for _, c := range line.Credits {
+      amount, _ := c.Amount.Float64()
+      credits += amount
+    }
+    item.Cost, item.Credits = billingCost(cost, credits, item.Currency)
+    for _, l := range line.Labels {
+      item.Labels[l.Key] = l.Value
+    }
+    items = append(items, item)
+  }
+  return items, scanner.Err()
+}
+
+// readBillingCSV reads a flattened export. Columns are named like the
+// export's, with "." or "_" for nested ones, e.g. "sku.description" or
+// "sku_description". Labels are a JSON array of key/value objects,
+// as BigQuery's TO_JSON_STRING writes them, or key=value pairs
+// separated by ";". Credits are a JSON array of objects with an amount,
+// or their sum.
+func readBillingCSV(r io.Reader) ([]billingItem, error) {
+  rows, err := csv.NewReader(r).ReadAll()
+  if err != nil {
+    return nil, err
+  }
+  if len(rows) == 0 {
+    return nil, nil
+  }
+
+  cols := map[string]int{}
+  for i, name := range rows[0] {
+    cols[strings.Replace(strings.ToLower(strings.TrimSpace(name)), ".", "_", -1)] = i
+  }
+  get := func(row []string, name string) string {
+    if i, ok := cols[name]; ok && i < len(row) {
+      return row[i]
+    }
+    return ""
+  }
+
+  var items []billingItem
+  for _, row := range rows[1:] {
+    item := billingItem{
+      Service: get(row, "service_description"),
+      SKU: get(row, "sku_description"),
+      Project: get(row, "project_id"),
+      Start: parseBillingTime(get(row, "usage_start_time")),
+      End: parseBillingTime(get(row, "usage_end_time")),
+      Labels: parseBillingLabels(get(row, "labels")),
+      Currency: get(row, "currency"),
+    }
+    cost, err := strconv.ParseFloat(get(row, "cost"), 64)
+    if err != nil {
+      return nil, fmt.Errorf("bad cost %q", get(row, "cost"))
+    }
+    credits, err := parseBillingCredits(get(row, "credits"))
+    if err != nil {
+      return nil, err
+    }
+    item.Cost, item.Credits = billingCost(cost, credits, item.Currency)
+    items = append(items, item)
+  }
+  return items, nil
+}
+
+// billingCost converts a line item's cost and credits, which are
+// negative, and takes the credits off the cost. Items without a currency
+// are taken to be in USD, like the estimates.
+func billingCost(cost, credits float64, currency string) (money, money) {
+  if currency == "" {
+    currency = "USD"
+  }
+  c := newMoney(credits, currency)
+  return newMoney(cost, currency).Add(c), c
+}
+
+func parseBillingCredits(s string) (float64, error) {
+  s = strings.TrimSpace(s)
+  if s == "" {
+    return 0, nil
+  }
+  if strings.HasPrefix(s, "[") {
+    var credits []struct {
+      Amount float64 `json:"amount"`
+    }
+    if err := json.Unmarshal([]byte(s), &credits); err != nil {
+      return 0, fmt.Errorf("bad credits %q", s)
+    }
+    sum := 0.0
+    for _, c := range credits {
+      sum += c.Amount
+    }
+    return sum, nil
+  }
+  sum, err := strconv.ParseFloat(s, 64)
+  if err != nil {
+    return 0, fmt.Errorf("bad credits %q", s)
+  }
+  return sum, nil
+}
+
+func parseBillingLabels(s string) map[string]string {
+  labels := map[string]string{}
+  s = strings.TrimSpace(s)
+  if strings.HasPrefix(s, "[") {
+    var kvs []struct {
+      Key string `json:"key"`
+      Value string `json:"value"`
+    }
+    json.Unmarshal([]byte(s), &kvs)
+    for _, kv := range kvs {
+      labels[kv.Key] = kv.Value
+    }
+    return labels
+  }
+  for _, f := range strings.Split(s, ";") {
+    parts := strings.SplitN(strings.TrimSpace(f), "=", 2)
+    if len(parts) == 2 {
+      labels[parts[0]] = parts[1]
+    }
+  }
+  return labels
+}
+
+// parseBillingTime reads the timestamps BigQuery writes,
+// e.g. "2018-01-02 03:00:00 UTC", or RFC 3339 ones.
+func parseBillingTime(s string) time.Time {
+  for _, layout := range []string{"2006-01-02 15:04:05 MST", "2006-01-02 15:04:05.999999 MST", time.RFC3339} {
+    if t, err := time.Parse(layout, s); err == nil {
+      return t.UTC()
+    }
+  }
+  return time.Time{}
+}
+
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  items, err := loadBillingExport(os.Getenv("BILLING_EXPORT"))
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  var keys []string
+  for _, k := range strings.Split(os.Getenv("RECONCILE_LABELS"), ",") {
+    if k = strings.TrimSpace(k); k != "" {
+      keys = append(keys, k)
+    }
+  }
+
+  err = render(w, r, reconcileTpl, "Reconciliation", struct {
+    Project string
+    Report reconcileReport
+  }{
+    Project: project,
+    Report: reconcile(ops, items, project, keys, requestCurrency(r)),
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+type reconcileRow struct {
+  Key string
+  Estimated money
+  Actual money
+  // Diff is unknown when the bill's currency has no exchange rate.
+  Diff money
+  Highlight bool
+}
+
+// reconcileSKU is the billed cost of one SKU. Covered SKUs are the ones
+// the dashboard estimates, i.e. VM time; the rest, such as disks and
+// network, are a source of difference between estimate and bill.
+type reconcileSKU struct {
+  SKU string
+  Service string
+  Actual money
+  Covered bool
+  Highlight bool
+}
+
+type reconcileReport struct {
+  ByDay []reconcileRow
+  BySKU []reconcileSKU
+  ByLabel []reconcileRow
+  Estimated money
+  // Actual is net of Credits.
+  Actual money
+  Credits money
+  // ActualCovered is the billed cost of SKUs the estimate covers.
+  ActualCovered money
+  Matched int
+  Unmatched int
+  UnmatchedCost money
+  From time.Time
+  To time.Time
+  // Currency is what amounts are shown in. Currencies lists billing
+  // currencies other than it, which are converted at the rate of the
+  // day each line item started.
+  Currency string
+  Currencies []string
+}
+
+// isVMTimeSKU reports whether a SKU bills the VM time which operations
+// are estimated with, e.g. "N1 Predefined Instance Core running in Americas".
+func isVMTimeSKU(item billingItem) bool {
+  if item.Service != "" && item.Service != "Compute Engine" {
+    return false
+  }
+  sku := strings.ToLower(item.SKU)
+  return strings.Contains(sku, "instance core") || strings.Contains(sku, "instance ram") ||
+    strings.HasPrefix(sku, "preemptible ") && (strings.Contains(sku, "core") || strings.Contains(sku, "ram"))
+}
+
+// reconcileLabels returns the labels of a line item which are compared
+// with operation labels: the given keys, or if there are none, every
+// label Google didn't add itself.
+func reconcileLabels(item billingItem, keys []string) map[string]string {
+  labels := map[string]string{}
+  if len(keys) != 0 {
+    for _, k := range keys {
+      if v, ok := item.Labels[k]; ok {
+        labels[k] = v
+      }
+    }
+    return labels
+  }
+  for k, v := range item.Labels {
+    if !strings.HasPrefix(k, "goog-") {
+      labels[k] = v
+    }
+  }
+  return labels
+}
+
+// reconcile matches the project's billing line items to operations which
+// have all of the item's labels and ran during its usage window, and
+// compares what was billed for them with the estimates of operations which
+// ran during the period the export covers, in currency.
+func reconcile(ops []tplOp, items []billingItem, project string, keys []string, currency string) reconcileReport {
+  report := reconcileReport{Currency: currency}
+  ops = convertOps(ops, currency)
+
+  currencies := map[string]bool{}
+  var matched []billingItem
+  for _, item := range items {
+    if item.Project != "" && item.Project != project {
+      continue
+    }
+    if item.Currency != "" && item.Currency != currency {
+      currencies[item.Currency] = true
+    }
+    item.Cost = currencyConf.Rates.convert(item.Cost, currency, item.Start)
+    item.Credits = currencyConf.Rates.convert(item.Credits, currency, item.Start)
+    // Billed labels are as messy as operation labels, and get the same
+    // clean-up.
+    item.Labels = allocConf.normalize(item.Labels)
+    labels := reconcileLabels(item, keys)
+    ok := false
+    for _, op := range ops {
+      if len(labels) != 0 && labelsMatch(op, labels) && overlaps(op, item.Start, item.End) {
+        ok = true
+        break
+      }
+    }
+    if !ok {
+      report.Unmatched++
+      report.UnmatchedCost = report.UnmatchedCost.Add(item.Cost)
+      continue
+    }
+
+    report.Matched++
+    matched = append(matched, item)
+    if report.From.IsZero() || item.Start.Before(report.From) {
+      report.From = item.Start
+    }
+    if item.End.After(report.To) {
+      report.To = item.End
+    }
+  }
+  for c := range currencies {
+    report.Currencies = append(report.Currencies, c)
+  }
+  sort.Strings(report.Currencies)
+
+  var inPeriod []tplOp
+  for _, op := range ops {
+    if !op.Cost.Unknown() && overlaps(op, report.From, report.To) {
+      inPeriod = append(inPeriod, op)
+    }
+  }
+
+  byDay := map[string]*reconcileRow{}
+  byLabel := map[string]*reconcileRow{}
+  add := func(m map[string]*reconcileRow, key string, estimated, actual money) {
+    row, ok := m[key]
+    if !ok {
+      row = &reconcileRow{Key: key}
+      m[key] = row
+    }
+    row.Estimated = row.Estimated.Add(estimated)
+    row.Actual = row.Actual.Add(actual)
+  }
+
+  for day, cost := range dailyCosts(inPeriod) {
+    if !day.Before(truncateDay(report.From)) && day.Before(report.To) {
+      add(byDay, day.Format("2006-01-02"), newMoney(cost, currency), money{})
+      report.Estimated = report.Estimated.Add(newMoney(cost, currency))
+    }
+  }
+  for _, op := range allocateOps(inPeriod) {
+    for k, v := range op.Labels {
+      if len(keys) == 0 || containsString(keys, k) {
+        add(byLabel, k + "=" + v, op.Cost, money{})
+      }
+    }
+  }
+
+  bySKU := map[string]*reconcileSKU{}
+  for _, item := range matched {
+    report.Actual = report.Actual.Add(item.Cost)
+    report.Credits = report.Credits.Add(item.Credits)
+    add(byDay, item.Start.Format("2006-01-02"), money{}, item.Cost)
+    for _, share := range allocConf.shares(tplOp{Labels: item.Labels}) {
+      for k, v := range reconcileLabels(billingItem{Labels: share.Labels}, keys) {
+        add(byLabel, k + "=" + v, money{}, item.Cost.Mul(share.Fraction))
+      }
+    }
+
+    s, ok := bySKU[item.SKU]
+    if !ok {
+      s = &reconcileSKU{SKU: item.SKU, Service: item.Service, Covered: isVMTimeSKU(item)}
+      bySKU[item.SKU] = s
+    }
+    s.Actual = s.Actual.Add(item.Cost)
+    if s.Covered {
+      report.ActualCovered = report.ActualCovered.Add(item.Cost)
+    }
+  }
+
+  report.ByDay = reconcileRows(byDay)
+  sort.Slice(report.ByDay, func(i, j int) bool {
+    return report.ByDay[i].Key < report.ByDay[j].Key
+  })
+  report.ByLabel = reconcileRows(byLabel)
+  sort.Slice(report.ByLabel, func(i, j int) bool {
+    a, b := report.ByLabel[i], report.ByLabel[j]
+    if c := a.Diff.Abs().Cmp(b.Diff.Abs()); c != 0 {
+      return c > 0
+    }
+    return a.Key < b.Key
+  })
+
+  for _, s := range bySKU {
+    report.BySKU = append(report.BySKU, *s)
+  }
+  sort.Slice(report.BySKU, func(i, j int) bool {
+    a, b := report.BySKU[i], report.BySKU[j]
+    if c := a.Actual.Cmp(b.Actual); c != 0 {
+      return c > 0
+    }
+    return a.SKU < b.SKU
+  })
+  // The SKUs which explain most of the difference are the biggest ones
+  // the estimate doesn't cover.
+  n := 0
+  for i := range report.BySKU {
+    if n < reconcileHighlights && !report.BySKU[i].Covered && !report.BySKU[i].Actual.IsZero() {
+      report.BySKU[i].Highlight = true
+      n++
+    }
+  }
+  return report
+}
+
+// reconcileRows computes differences and highlights the biggest ones.
+func reconcileRows(m map[string]*reconcileRow) []reconcileRow {
+  var rows []reconcileRow
+  for _, row := range m {
+    row.Diff = row.Actual.Sub(row.Estimated)
+    rows = append(rows, *row)
+  }
+
+  order := make([]int, len(rows))
+  for i := range order {
+    order[i] = i
+  }
+  sort.Slice(order, func(i, j int) bool {
+    return rows[order[i]].Diff.Abs().Cmp(rows[order[j]].Diff.Abs()) > 0
+  })
+  for i, idx := range order {
+    if i == reconcileHighlights || rows[idx].Diff.Unknown() || rows[idx].Diff.IsZero() {
+      break
+    }
+    rows[idx].Highlight = true
+  }
+  return rows
+}
+
+func labelsMatch(op tplOp, labels map[string]string) bool {
+  for k, v := range labels {
+    if op.Labels[k] != v {
+      return false
+    }
+  }
+  return true
+}
+
+// overlaps reports whether an operation ran at some point between from and to.
+func overlaps(op tplOp, from, to time.Time) bool {
+  return op.StartTime.Before(to) && from.Before(op.StartTime.Add(op.Duration))
+}
+
+func containsString(list []string, s string) bool {
+  for _, v := range list {
+    if v == s {
+      return true
+    }
+  }
+  return false
+}
+
+var reconcileTpl = newPage("reconcile")
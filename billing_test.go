@@ -0,0 +1,89 @@
+package hello
+
+import (
+  "strings"
+  "testing"
+  "time"
+
+  genomics "google.golang.org/api/genomics/v1"
+)
+
+func TestReadBillingCredits(t *testing.T) {
+  ndjson := `{"cost": 1.5, "currency": "USD", "credits": [{"name": "Sustained use", "amount": -0.25}, {"amount": -0.25}]}
+{"cost": 2, "currency": "USD"}
+`
+  csv := `cost,currency,credits
+1.5,USD,"[{""name"": ""Sustained use"", ""amount"": -0.5}]"
+2,USD,-1
+2,,
+`
+  for _, c := range []struct {
+    name string
+    read func() ([]billingItem, error)
+    costs []string
+    credits []string
+  }{
+    {"ndjson", func() ([]billingItem, error) { return readBillingNDJSON(strings.NewReader(ndjson)) },
+      []string{"1.000000", "2.000000"}, []string{"-0.500000", "0.000000"}},
+    {"csv", func() ([]billingItem, error) { return readBillingCSV(strings.NewReader(csv)) },
+      []string{"1.000000", "1.000000", "2.000000"}, []string{"-0.500000", "-1.000000", "0.000000"}},
+  } {
+    items, err := c.read()
+    if err != nil {
+      t.Errorf("%s: %s", c.name, err)
+      continue
+    }
+    if len(items) != len(c.costs) {
+      t.Errorf("%s: %d items, want %d", c.name, len(items), len(c.costs))
+      continue
+    }
+    for i, item := range items {
+      if item.Cost.String() != c.costs[i] || item.Credits.String() != c.credits[i] || item.Cost.Currency() != "USD" {
+        t.Errorf("%s item %d: cost %s %s, credits %s; want %s, %s", c.name, i, item.Cost, item.Cost.Currency(), item.Credits, c.costs[i], c.credits[i])
+      }
+    }
+  }
+
+  if _, err := readBillingCSV(strings.NewReader("cost,credits\n1,lots\n")); err == nil {
+    t.Error("bad credits accepted")
+  }
+}
+
+func TestReconcileCreditsInAnotherCurrency(t *testing.T) {
+  old := currencyConf
+  defer func() { currencyConf = old }()
+  currencyConf = currencyConfig{Rates: exchangeRates{}}
+  currencyConf.Rates.add("EUR", exchangeRate{Rate: 0.8})
+
+  start := time.Date(2018, 1, 15, 9, 0, 0, 0, time.UTC)
+  op := tplOp{
+    Name: "op",
+    Labels: map[string]string{"sample": "s1"},
+    GCE: &genomics.ComputeEngine{MachineType: "us-central1-f/n1-standard-1"},
+    StartTime: start,
+    Duration: time.Hour,
+    Hours: 1,
+    Cost: usd(1),
+  }
+  // One line item has credits and one has none.
+  items, err := readBillingNDJSON(strings.NewReader(`{"project": {"id": "p"}, "labels": [{"key": "sample", "value": "s1"}], "usage_start_time": "2018-01-15 09:00:00 UTC", "usage_end_time": "2018-01-15 10:00:00 UTC", "cost": 2, "currency": "USD", "credits": [{"amount": -1}]}
+{"project": {"id": "p"}, "labels": [{"key": "sample", "value": "s1"}], "usage_start_time": "2018-01-15 09:00:00 UTC", "usage_end_time": "2018-01-15 10:00:00 UTC", "cost": 1, "currency": "USD"}
+`))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  rep := reconcile([]tplOp{op}, items, "p", nil, "EUR")
+  if rep.Matched != 2 {
+    t.Fatalf("%d items matched, want 2", rep.Matched)
+  }
+  if rep.Actual.String() != "1.600000" || rep.Actual.Currency() != "EUR" {
+    t.Errorf("billed %s %s, want 1.600000 EUR", rep.Actual, rep.Actual.Currency())
+  }
+  if rep.Credits.String() != "-0.800000" || rep.Credits.Currency() != "EUR" {
+    t.Errorf("credits %s %s, want -0.800000 EUR", rep.Credits, rep.Credits.Currency())
+  }
+  if rep.Estimated.String() != "0.800000" || len(rep.ByDay) != 1 || rep.ByDay[0].Diff.String() != "0.800000" {
+    t.Errorf("estimated %s, by day %+v", rep.Estimated, rep.ByDay)
+  }
+}
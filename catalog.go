@@ -0,0 +1,175 @@
+package hello
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// priceCatalog is one version of the price list, as published by the
+// pricing calculator, along with the VM prices found in it.
+type priceCatalog struct {
+  Version string
+  Updated time.Time
+  PriceList map[string]interface{}
+  // VMPrices maps "price-region/machine-type" to an hourly price.
+  VMPrices map[string]float64
+  Regions map[string]bool
+  Specs map[string]vmSpec
+}
+
+// priceCatalogs are the known versions of the price list, oldest first.
+// The last one is the current one.
+var priceCatalogs []*priceCatalog
+
+func currentCatalog() *priceCatalog {
+  return priceCatalogs[len(priceCatalogs) - 1]
+}
+
+// catalogAt returns the price list in effect at a time. Operations which
+// ran before the oldest known price list are priced with that one.
+func catalogAt(t time.Time) *priceCatalog {
+  c := priceCatalogs[0]
+  for _, cat := range priceCatalogs[1:] {
+    if cat.Updated.After(t) {
+      break
+    }
+    c = cat
+  }
+  return c
+}
+
+func parsePriceCatalog(raw []byte) (*priceCatalog, error) {
+  var data struct {
+    Version string
+    Updated string
+    PriceList map[string]interface{} `json:"gcp_price_list"`
+  }
+  if err := json.Unmarshal(raw, &data); err != nil {
+    return nil, err
+  }
+  updated, err := parseCatalogDate(data.Updated)
+  if err != nil {
+    return nil, err
+  }
+
+  c := &priceCatalog{
+    Version: data.Version,
+    Updated: updated,
+    PriceList: data.PriceList,
+    VMPrices: map[string]float64{},
+    Regions: map[string]bool{},
+    Specs: map[string]vmSpec{},
+  }
+  for k, i := range data.PriceList {
+    if !strings.HasPrefix(k, "CP-COMPUTEENGINE-VMIMAGE-") {
+      continue
+    }
+    vm := strings.ToLower(strings.TrimPrefix(k, "CP-COMPUTEENGINE-VMIMAGE-"))
+    dat, ok := i.(map[string]interface{})
+    if !ok {
+      continue
+    }
+
+    spec := vmSpec{}
+    if c, ok := dat["cores"].(string); ok {
+      spec.Cores, _ = strconv.ParseFloat(c, 64)
+    }
+    if m, ok := dat["memory"].(string); ok {
+      spec.MemoryGB, _ = strconv.ParseFloat(m, 64)
+    }
+    c.Specs[vm] = spec
+
+    for r, v := range dat {
+      price, ok := v.(float64)
+      if !ok || vmSpecFields[r] {
+        continue
+      }
+      c.Regions[r] = true
+      c.VMPrices[r + "/" + vm] = price
+    }
+  }
+  return c, nil
+}
+
+// parseCatalogDate reads the price list's "updated" field,
+// e.g. "12-December-2017".
+func parseCatalogDate(s string) (time.Time, error) {
+  for _, layout := range []string{"2-January-2006", "2-Jan-2006", "January 2, 2006", "2006-01-02"} {
+    if t, err := time.Parse(layout, s); err == nil {
+      return t, nil
+    }
+  }
+  return time.Time{}, fmt.Errorf("price list: unknown updated date %q", s)
+}
+
+// loadPriceCatalogs reads the built-in price list and any others in
+// PRICE_CATALOGS, a comma-separated list of paths or globs of saved copies
+// of the pricing calculator's JSON. A file with the same version as the
+// built-in price list replaces it.
+func loadPriceCatalogs(builtin []byte, patterns string) ([]*priceCatalog, error) {
+  c, err := parsePriceCatalog(builtin)
+  if err != nil {
+    return nil, err
+  }
+  byVersion := map[string]*priceCatalog{c.Version: c}
+
+  for _, pattern := range strings.Split(patterns, ",") {
+    pattern = strings.TrimSpace(pattern)
+    if pattern == "" {
+      continue
+    }
+    paths, err := filepath.Glob(pattern)
+    if err != nil {
+      return nil, err
+    }
+    for _, p := range paths {
+      raw, err := ioutil.ReadFile(p)
+      if err != nil {
+        return nil, err
+      }
+      c, err := parsePriceCatalog(raw)
+      if err != nil {
+        return nil, fmt.Errorf("%s: %s", p, err)
+      }
+      byVersion[c.Version] = c
+    }
+  }
+
+  var catalogs []*priceCatalog
+  for _, c := range byVersion {
+    catalogs = append(catalogs, c)
+  }
+  sort.Slice(catalogs, func(i, j int) bool {
+    if !catalogs[i].Updated.Equal(catalogs[j].Updated) {
+      return catalogs[i].Updated.Before(catalogs[j].Updated)
+    }
+    return catalogs[i].Version < catalogs[j].Version
+  })
+  return catalogs, nil
+}
+
+// atCurrentPrices returns copies of operations priced with the current
+// price list instead of the one in effect when they ran.
+func atCurrentPrices(ops []tplOp) []tplOp {
+  c := currentCatalog()
+  var out []tplOp
+  for _, op := range ops {
+    price, ok := c.vmPrice(op.GCE.MachineType)
+    op.Hourly = price.Hourly
+    op.PriceRegion = price.Region
+    op.FallbackPrice = price.Fallback
+    op.PriceVersion = c.Version
+    op.Cost = unknownMoney
+    if ok {
+      op.Cost = op.Hourly.Mul(op.Hours)
+    }
+    out = append(out, op)
+  }
+  return out
+}
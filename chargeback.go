@@ -0,0 +1,248 @@
+package hello
+
+import (
+  "encoding/csv"
+  "fmt"
+  "net/http"
+  "os"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/chargeback", requireRole(roleFinance, chargebackHandler))
+}
+
+// chargebackRule recharges operations whose Label matches Pattern, a glob
+// like "R01*", to a cost center.
+type chargebackRule struct {
+  Label string
+  Pattern string
+  CostCenter string
+}
+
+func (r chargebackRule) String() string {
+  return r.Label + "=" + r.Pattern
+}
+
+func (r chargebackRule) match(op tplOp) bool {
+  v, ok := op.Labels[r.Label]
+  if !ok {
+    return false
+  }
+  ok, _ = path.Match(r.Pattern, v)
+  return ok
+}
+
+// parseChargebackRules reads rules from a comma-separated list of
+// label=pattern:cost-center entries, e.g.
+// "lab=smith:CC-1001,grant=R01*:CC-2002", as found in the CHARGEBACK_RULES
+// environment variable. An operation is recharged by the first rule
+// it matches.
+func parseChargebackRules(s string) ([]chargebackRule, error) {
+  var rules []chargebackRule
+  for _, f := range strings.Split(s, ",") {
+    f = strings.TrimSpace(f)
+    if f == "" {
+      continue
+    }
+    i := strings.LastIndex(f, ":")
+    j := strings.Index(f, "=")
+    if i == -1 || j == -1 || j > i {
+      return nil, fmt.Errorf("chargeback rule %q: expected label=pattern:cost-center", f)
+    }
+    r := chargebackRule{Label: f[:j], Pattern: f[j + 1:i], CostCenter: f[i + 1:]}
+    if _, err := path.Match(r.Pattern, ""); err != nil {
+      return nil, fmt.Errorf("chargeback rule %q: %s", f, err)
+    }
+    if r.Label == "" || r.CostCenter == "" {
+      return nil, fmt.Errorf("chargeback rule %q: expected label=pattern:cost-center", f)
+    }
+    rules = append(rules, r)
+  }
+  return rules, nil
+}
+
+// invoiceLine is an operation recharged to a cost center, and the rule
+// which matched it.
+type invoiceLine struct {
+  Op tplOp
+  Rule string
+}
+
+// invoice itemises what a cost center is recharged for one month.
+// Operations whose cost is unknown are listed but counted in Unknown
+// rather than added to Total.
+type invoice struct {
+  CostCenter string
+  Lines []invoiceLine
+  Hours float64
+  Total money
+  Unknown int
+}
+
+type chargebackReport struct {
+  Month time.Time
+  Currency string
+  Invoices []invoice
+  // Unmatched are the month's operations no rule matched.
+  Unmatched []tplOp
+  UnmatchedTotals opTotals
+}
+
+func (r chargebackReport) MonthName() string {
+  return r.Month.Format("2006-01")
+}
+
+func chargebackHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  rules, err := parseChargebackRules(os.Getenv("CHARGEBACK_RULES"))
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  // The month is picked with the "month" query parameter, YYYY-MM,
+  // and is the current one by default.
+  now := time.Now().UTC()
+  month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+  if t, err := time.Parse("2006-01", r.URL.Query().Get("month")); err == nil {
+    month = t
+  }
+
+  currency := requestCurrency(r)
+  report := chargeback(allocateOps(convertOps(ops, currency)), rules, month)
+  report.Currency = currency
+
+  if r.URL.Query().Get("format") == "csv" {
+    writeInvoiceCSV(w, report, r.URL.Query().Get("cost_center"))
+    return
+  }
+
+  err = render(w, r, chargebackTpl, "Chargeback", struct {
+    Project string
+    Rules []chargebackRule
+    Report chargebackReport
+  }{
+    Project: project,
+    Rules: rules,
+    Report: report,
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// chargeback assigns the operations which started in a month to cost
+// centers, making an invoice for each. ops are the shares allocateOps
+// splits operations into, so rules match each share's labels, and an
+// operation which allocation rules split between labs is recharged to
+// each lab's cost center.
+func chargeback(ops []tplOp, rules []chargebackRule, month time.Time) chargebackReport {
+  report := chargebackReport{Month: month}
+  end := month.AddDate(0, 1, 0)
+
+  var inMonth []tplOp
+  for _, op := range ops {
+    if !op.StartTime.Before(month) && op.StartTime.Before(end) {
+      inMonth = append(inMonth, op)
+    }
+  }
+  sort.Slice(inMonth, func(i, j int) bool {
+    return inMonth[i].StartTime.Before(inMonth[j].StartTime)
+  })
+
+  invoices := map[string]*invoice{}
+  for _, op := range inMonth {
+    var rule *chargebackRule
+    for i := range rules {
+      if rules[i].match(op) {
+        rule = &rules[i]
+        break
+      }
+    }
+    if rule == nil {
+      report.Unmatched = append(report.Unmatched, op)
+      continue
+    }
+
+    inv, ok := invoices[rule.CostCenter]
+    if !ok {
+      inv = &invoice{CostCenter: rule.CostCenter}
+      invoices[rule.CostCenter] = inv
+    }
+    inv.Lines = append(inv.Lines, invoiceLine{op, rule.String()})
+    inv.Hours += op.Hours
+    if op.Cost.Unknown() {
+      inv.Unknown++
+    } else {
+      inv.Total = inv.Total.Add(op.Cost)
+    }
+  }
+  report.UnmatchedTotals = totalOps(report.Unmatched)
+
+  for _, inv := range invoices {
+    report.Invoices = append(report.Invoices, *inv)
+  }
+  sort.Slice(report.Invoices, func(i, j int) bool {
+    return report.Invoices[i].CostCenter < report.Invoices[j].CostCenter
+  })
+  return report
+}
+
+// writeInvoiceCSV writes the invoice of one cost center, or of all of them
+// if costCenter is empty, one row per operation.
+func writeInvoiceCSV(w http.ResponseWriter, report chargebackReport, costCenter string) {
+  name := "invoices-" + report.MonthName() + ".csv"
+  if costCenter != "" {
+    name = "invoice-" + costCenter + "-" + report.MonthName() + ".csv"
+  }
+  w.Header().Set("content-type", "text/csv")
+  w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+  cw := csv.NewWriter(w)
+  cw.Write([]string{"cost_center", "month", "operation", "pipeline", "rule", "start_time",
+    "machine_type", "share", "hours", "cost", "currency"})
+  for _, inv := range report.Invoices {
+    if costCenter != "" && inv.CostCenter != costCenter {
+      continue
+    }
+    for _, l := range inv.Lines {
+      cw.Write([]string{
+        inv.CostCenter,
+        report.MonthName(),
+        l.Op.Name,
+        l.Op.PipelineName(),
+        l.Rule,
+        l.Op.StartTime.UTC().Format(time.RFC3339),
+        l.Op.GCE.MachineType,
+        strconv.FormatFloat(l.Op.Share, 'f', -1, 64),
+        strconv.FormatFloat(l.Op.Hours, 'f', -1, 64),
+        l.Op.Cost.String(),
+        report.Currency,
+      })
+    }
+  }
+  cw.Flush()
+}
+
+var chargebackTpl = newPage("chargeback")
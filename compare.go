@@ -0,0 +1,369 @@
+package hello
+
+import (
+  "fmt"
+  "net/http"
+  "net/url"
+  "sort"
+  "time"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/compare", requireRole(roleViewer, compareHandler))
+}
+
+// comparePeriod is a range of days, To exclusive, like opFilter's.
+type comparePeriod struct {
+  From time.Time
+  To time.Time
+}
+
+func (p comparePeriod) FromDate() string {
+  return p.From.Format("2006-01-02")
+}
+
+func (p comparePeriod) ToDate() string {
+  return p.To.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+func (p comparePeriod) String() string {
+  return p.FromDate() + " to " + p.ToDate()
+}
+
+func (p comparePeriod) contains(t time.Time) bool {
+  return !t.Before(p.From) && t.Before(p.To)
+}
+
+// before returns the period to compare a period with: the calendar month
+// before if it's a calendar month, or else as many days just before it.
+func (p comparePeriod) before() comparePeriod {
+  if p.From.Day() == 1 && p.To.Equal(p.From.AddDate(0, 1, 0)) {
+    return comparePeriod{p.From.AddDate(0, -1, 0), p.From}
+  }
+  return comparePeriod{p.From.Add(-p.To.Sub(p.From)), p.From}
+}
+
+// sameDaysMonthBefore returns the same days of the month before a period
+// which starts on the 1st, e.g. the 1st to the 10th of last month for the
+// 1st to the 10th of this month. Days the month before doesn't have are
+// left out.
+func (p comparePeriod) sameDaysMonthBefore() comparePeriod {
+  from := p.From.AddDate(0, -1, 0)
+  to := from.Add(p.To.Sub(p.From))
+  if to.After(p.From) {
+    to = p.From
+  }
+  return comparePeriod{from, to}
+}
+
+// compareRow is what one value of a dimension, like a machine type or a
+// label's value, cost in each period.
+type compareRow struct {
+  Dimension string
+  Value string
+  BaseOps int
+  CurrentOps int
+  Base money
+  Current money
+  Delta money
+  // Contribution is Delta as a fraction of the change in the total.
+  Contribution float64
+  Unknown int
+  // Link shows the comparison for just this value, when the dimension
+  // can be filtered by.
+  Link string
+}
+
+func (r compareRow) ContributionPercent() string {
+  return fmt.Sprintf("%.1f%%", r.Contribution * 100)
+}
+
+type compareDimension struct {
+  Name string
+  Rows []compareRow
+}
+
+// compareOp is an operation in one of the compared periods.
+type compareOp struct {
+  Period string
+  Op tplOp
+}
+
+type compareReport struct {
+  Current comparePeriod
+  Base comparePeriod
+  Currency string
+  CurrentCount int
+  BaseCount int
+  CurrentTotals opTotals
+  BaseTotals opTotals
+  Delta money
+  Dimensions []compareDimension
+  // Drivers are the values, of any dimension, whose cost changed the
+  // most, biggest first.
+  Drivers []compareRow
+  Ops []compareOp
+}
+
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  // The current period is picked with "from" and "to" and is this month
+  // so far by default, which is compared with the same days of last month.
+  // Otherwise it's compared with the one just before, unless that's picked
+  // with "base_from" and "base_to".
+  filter := parseOpFilter(r)
+  now := time.Now().UTC()
+  current := comparePeriod{filter.From, filter.To}
+  monthToDate := current.From.IsZero() && current.To.IsZero()
+  if current.From.IsZero() {
+    current.From = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+  }
+  if current.To.IsZero() {
+    current.To = time.Date(now.Year(), now.Month(), now.Day() + 1, 0, 0, 0, 0, time.UTC)
+  }
+  base := current.before()
+  if monthToDate {
+    base = current.sameDaysMonthBefore()
+  }
+  q := r.URL.Query()
+  if t, err := time.Parse("2006-01-02", q.Get("base_from")); err == nil {
+    base.From = t
+  }
+  if t, err := time.Parse("2006-01-02", q.Get("base_to")); err == nil {
+    base.To = t.AddDate(0, 0, 1)
+  }
+  filter.From, filter.To = time.Time{}, time.Time{}
+
+  currency := requestCurrency(r)
+  report := compare(convertOps(filterOps(ops, filter), currency), project, current, base)
+  report.Currency = currency
+  report.link(filter)
+
+  err = render(w, r, compareTpl, "Compare", struct {
+    Project string
+    Filter opFilter
+    Report compareReport
+  }{
+    Project: project,
+    Filter: filter,
+    Report: report,
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// compareDimensions are the dimensions costs are broken down by, besides
+// labels. Each returns an operation's value and the opFilter query
+// parameter to drill down with, if there is one. Allocated dimensions are
+// broken down by the operations' shares, as their values can be labels.
+var compareDimensions = []struct {
+  Name string
+  Param string
+  Allocated bool
+  Value func(op tplOp, project string) string
+}{
+  // Operations are all the dashboard's project's, unless allocation rules
+  // give them a "project" label.
+  {"project", "", true, func(op tplOp, project string) string {
+    if p := op.Labels["project"]; p != "" {
+      return p
+    }
+    return project
+  }},
+  {"machine type", "machine_type", false, func(op tplOp, project string) string {
+    _, machine := splitMachineType(op.GCE.MachineType)
+    return machine
+  }},
+  {"zone", "zone", false, func(op tplOp, project string) string {
+    zone, _ := splitMachineType(op.GCE.MachineType)
+    return zone
+  }},
+}
+
+// compare breaks down how the cost of operations which started in one
+// period differs from those which started in another, by project, machine
+// type, zone and each label. Labels are broken down after allocation, so
+// split operations count towards each of their labels' values.
+func compare(ops []tplOp, project string, current, base comparePeriod) compareReport {
+  report := compareReport{Current: current, Base: base}
+
+  var currentOps, baseOps []tplOp
+  for _, op := range ops {
+    if current.contains(op.StartTime) {
+      currentOps = append(currentOps, op)
+      report.Ops = append(report.Ops, compareOp{"current", op})
+    }
+    if base.contains(op.StartTime) {
+      baseOps = append(baseOps, op)
+      report.Ops = append(report.Ops, compareOp{"base", op})
+    }
+  }
+  sort.SliceStable(report.Ops, func(i, j int) bool {
+    return report.Ops[i].Op.StartTime.Before(report.Ops[j].Op.StartTime)
+  })
+  report.CurrentCount, report.BaseCount = len(currentOps), len(baseOps)
+  report.CurrentTotals = totalOps(currentOps)
+  report.BaseTotals = totalOps(baseOps)
+  report.Delta = report.CurrentTotals.Cost.Sub(report.BaseTotals.Cost)
+
+  currentShares, baseShares := allocateOps(currentOps), allocateOps(baseOps)
+  for _, d := range compareDimensions {
+    value := d.Value
+    cur, bas := currentOps, baseOps
+    if d.Allocated {
+      cur, bas = currentShares, baseShares
+    }
+    report.addDimension(d.Name, d.Param, cur, bas, func(op tplOp) string {
+      return value(op, project)
+    })
+  }
+
+  keys := map[string]bool{}
+  for _, ops := range [][]tplOp{currentShares, baseShares} {
+    for _, op := range ops {
+      for k := range op.Labels {
+        keys[k] = true
+      }
+    }
+  }
+  var sorted []string
+  for k := range keys {
+    sorted = append(sorted, k)
+  }
+  sort.Strings(sorted)
+  for _, k := range sorted {
+    key := k
+    report.addDimension("label " + key, "label", currentShares, baseShares, func(op tplOp) string {
+      if v, ok := op.Labels[key]; ok {
+        return key + "=" + v
+      }
+      return "(none)"
+    })
+  }
+
+  // A dimension with a single value just repeats the total, so it can't
+  // say what drove the change.
+  for _, d := range report.Dimensions {
+    if len(d.Rows) < 2 {
+      continue
+    }
+    for _, row := range d.Rows {
+      if !row.Delta.IsZero() {
+        report.Drivers = append(report.Drivers, row)
+      }
+    }
+  }
+  sortCompareRows(report.Drivers)
+  if len(report.Drivers) > 10 {
+    report.Drivers = report.Drivers[:10]
+  }
+  return report
+}
+
+func (report *compareReport) addDimension(name, param string, currentOps, baseOps []tplOp, value func(tplOp) string) {
+  rows := map[string]*compareRow{}
+  row := func(op tplOp) *compareRow {
+    v := value(op)
+    r, ok := rows[v]
+    if !ok {
+      r = &compareRow{Dimension: name, Value: v}
+      if param != "" && v != "(none)" {
+        r.Link = param
+      }
+      rows[v] = r
+    }
+    return r
+  }
+  for _, op := range currentOps {
+    r := row(op)
+    r.CurrentOps++
+    if op.Cost.Unknown() {
+      r.Unknown++
+    } else {
+      r.Current = r.Current.Add(op.Cost)
+    }
+  }
+  for _, op := range baseOps {
+    r := row(op)
+    r.BaseOps++
+    if op.Cost.Unknown() {
+      r.Unknown++
+    } else {
+      r.Base = r.Base.Add(op.Cost)
+    }
+  }
+
+  d := compareDimension{Name: name}
+  total := report.Delta.Float()
+  for _, r := range rows {
+    r.Delta = r.Current.Sub(r.Base)
+    if total != 0 {
+      r.Contribution = r.Delta.Float() / total
+    }
+    d.Rows = append(d.Rows, *r)
+  }
+  sortCompareRows(d.Rows)
+  report.Dimensions = append(report.Dimensions, d)
+}
+
+// sortCompareRows sorts rows by how much their cost changed, either way.
+func sortCompareRows(rows []compareRow) {
+  sort.Slice(rows, func(i, j int) bool {
+    if c := rows[i].Delta.Abs().Cmp(rows[j].Delta.Abs()); c != 0 {
+      return c > 0
+    }
+    return rows[i].Value < rows[j].Value
+  })
+}
+
+// link turns the query parameter each row can be drilled down with into
+// a link to the comparison filtered by its value as well.
+func (report *compareReport) link(filter opFilter) {
+  q := url.Values{}
+  q.Set("from", report.Current.FromDate())
+  q.Set("to", report.Current.ToDate())
+  q.Set("base_from", report.Base.FromDate())
+  q.Set("base_to", report.Base.ToDate())
+  for param, v := range map[string]string{"machine": filter.Machine, "machine_type": filter.MachineType,
+    "zone": filter.Zone, "pipeline": filter.Pipeline, "label": filter.Label, "source": filter.Source} {
+    if v != "" {
+      q.Set(param, v)
+    }
+  }
+  set := func(rows []compareRow) {
+    for i, r := range rows {
+      if r.Link == "" {
+        continue
+      }
+      rq := url.Values{}
+      for k, v := range q {
+        rq[k] = v
+      }
+      rq.Set(r.Link, r.Value)
+      rows[i].Link = "/compare?" + rq.Encode()
+    }
+  }
+  for _, d := range report.Dimensions {
+    set(d.Rows)
+  }
+  set(report.Drivers)
+}
+
+var compareTpl = newPage("compare")
@@ -0,0 +1,370 @@
+package hello
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/cromwell", requireRole(roleViewer, cromwellHandler))
+}
+
+// cromwellMetadata is the subset of Cromwell's workflow metadata
+// (GET /api/workflows/v1/{id}/metadata) which the dashboard cares about.
+type cromwellMetadata struct {
+  ID string `json:"id"`
+  WorkflowName string `json:"workflowName"`
+  Status string `json:"status"`
+  Calls map[string][]cromwellCall `json:"calls"`
+}
+
+// cromwellCall is one attempt at one shard of a call. Calls of
+// subworkflows have the subworkflow's metadata instead of a job.
+type cromwellCall struct {
+  ShardIndex int `json:"shardIndex"`
+  Attempt int `json:"attempt"`
+  // JobID is the name of the Pipelines operation which ran the call.
+  JobID string `json:"jobId"`
+  ExecutionStatus string `json:"executionStatus"`
+  CallCaching struct {
+    Hit bool `json:"hit"`
+  } `json:"callCaching"`
+  SubWorkflowMetadata *cromwellMetadata `json:"subWorkflowMetadata"`
+}
+
+// cromwellShardRow is one attempt at one shard of a task. Shard is -1
+// for calls which aren't scattered.
+type cromwellShardRow struct {
+  Workflow string
+  Task string
+  Shard int
+  Attempt int
+  Status string
+  Op string
+  Cost money
+  // Cached calls reused an earlier result, so they're free.
+  Cached bool
+  // Unknown is true when the call's operation wasn't found or couldn't be priced.
+  Unknown bool
+  // Unlisted is true for operations labelled with a workflow
+  // which aren't in its metadata, whose shard isn't known.
+  Unlisted bool
+}
+
+type cromwellTaskRow struct {
+  Workflow string
+  Task string
+  Shards int
+  Calls int
+  CacheHits int
+  Cost money
+  Unknown int
+}
+
+type cromwellWorkflowRow struct {
+  ID string
+  Name string
+  Status string
+  Calls int
+  CacheHits int
+  Cost money
+  Unknown int
+}
+
+type cromwellReport struct {
+  Workflows []cromwellWorkflowRow
+  Tasks []cromwellTaskRow
+  Shards []cromwellShardRow
+  Errors []string
+}
+
+// cromwellClient fetches workflow metadata from a Cromwell server's REST
+// API. Client defaults to http.DefaultClient.
+type cromwellClient struct {
+  URL string
+  Client *http.Client
+}
+
+// cromwellWorkflowIDPattern matches Cromwell's workflow IDs, which are
+// UUIDs. IDs come from operation labels, which anyone starting a pipeline
+// can set, so nothing else is sent to the server.
+var cromwellWorkflowIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func (c cromwellClient) metadata(id string) (cromwellMetadata, error) {
+  client := c.Client
+  if client == nil {
+    client = http.DefaultClient
+  }
+
+  var m cromwellMetadata
+  if !cromwellWorkflowIDPattern.MatchString(id) {
+    return m, fmt.Errorf("cromwell workflow %q: not a workflow ID", id)
+  }
+  u := strings.TrimSuffix(c.URL, "/") + "/api/workflows/v1/" + url.PathEscape(id) + "/metadata?expandSubWorkflows=true"
+  resp, err := client.Get(u)
+  if err != nil {
+    return m, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return m, fmt.Errorf("cromwell workflow %s: %s", id, resp.Status)
+  }
+  err = json.NewDecoder(resp.Body).Decode(&m)
+  return m, err
+}
+
+// loadCromwellMetadata reads workflow metadata exported as *.json files
+// into a directory, one workflow per file.
+func loadCromwellMetadata(dir string) ([]cromwellMetadata, error) {
+  paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+  if err != nil {
+    return nil, err
+  }
+  var workflows []cromwellMetadata
+  for _, p := range paths {
+    b, err := ioutil.ReadFile(p)
+    if err != nil {
+      return nil, err
+    }
+    var m cromwellMetadata
+    if err := json.Unmarshal(b, &m); err != nil {
+      return nil, fmt.Errorf("cromwell metadata %s: %s", p, err)
+    }
+    workflows = append(workflows, m)
+  }
+  return workflows, nil
+}
+
+// cromwellWorkflowID returns the workflow ID Cromwell labelled an operation
+// with. Label values can't start with a digit, so Cromwell prefixes them.
+func cromwellWorkflowID(op tplOp) string {
+  return strings.TrimPrefix(op.Labels["cromwell-workflow-id"], "cromwell-")
+}
+
+func cromwellHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  // Metadata comes from CROMWELL_METADATA_DIR, and for workflows
+  // which aren't there, from the server at CROMWELL_URL.
+  var workflows []cromwellMetadata
+  var errs []string
+  if dir := os.Getenv("CROMWELL_METADATA_DIR"); dir != "" {
+    workflows, err = loadCromwellMetadata(dir)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
+      return
+    }
+  }
+  if u := os.Getenv("CROMWELL_URL"); u != "" {
+    have := map[string]bool{}
+    for _, wf := range workflows {
+      have[wf.ID] = true
+    }
+    client := cromwellClient{URL: u}
+    for _, op := range ops {
+      id := cromwellWorkflowID(op)
+      if id == "" || have[id] {
+        continue
+      }
+      have[id] = true
+      wf, err := client.metadata(id)
+      if err != nil {
+        errs = append(errs, err.Error())
+        continue
+      }
+      workflows = append(workflows, wf)
+    }
+  }
+
+  report := joinCromwell(workflows, convertOps(ops, requestCurrency(r)))
+  report.Errors = errs
+
+  err = render(w, r, cromwellTpl, "Cromwell", struct {
+    Project string
+    Report cromwellReport
+  }{
+    Project: project,
+    Report: report,
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// joinCromwell matches workflow calls to the operations which ran them by
+// job ID, and rolls their cost up per task and per workflow. Operations
+// labelled with a workflow but missing from its metadata, e.g. because the
+// metadata was exported before the workflow finished, are still counted.
+func joinCromwell(workflows []cromwellMetadata, ops []tplOp) cromwellReport {
+  byName := map[string]tplOp{}
+  for _, op := range ops {
+    byName[op.Name] = op
+  }
+  joined := map[string]bool{}
+
+  var shards []cromwellShardRow
+  var addCalls func(workflowID, prefix string, m cromwellMetadata)
+  addCalls = func(workflowID, prefix string, m cromwellMetadata) {
+    for task, calls := range m.Calls {
+      for _, c := range calls {
+        if c.SubWorkflowMetadata != nil {
+          addCalls(workflowID, prefix + task + "/", *c.SubWorkflowMetadata)
+          continue
+        }
+        row := cromwellShardRow{
+          Workflow: workflowID,
+          Task: prefix + task,
+          Shard: c.ShardIndex,
+          Attempt: c.Attempt,
+          Status: c.ExecutionStatus,
+          Cached: c.CallCaching.Hit,
+        }
+        if !row.Cached {
+          op, ok := byName[shortOpName(c.JobID)]
+          switch {
+          case c.JobID == "" || !ok || op.Cost.Unknown():
+            row.Unknown = true
+          default:
+            row.Cost = op.Cost
+          }
+          if ok {
+            row.Op = op.Name
+            joined[op.Name] = true
+          }
+        }
+        shards = append(shards, row)
+      }
+    }
+  }
+
+  report := cromwellReport{}
+  names := map[string]cromwellWorkflowRow{}
+  for _, wf := range workflows {
+    addCalls(wf.ID, "", wf)
+    names[wf.ID] = cromwellWorkflowRow{ID: wf.ID, Name: wf.WorkflowName, Status: wf.Status}
+  }
+
+  for _, op := range ops {
+    id := cromwellWorkflowID(op)
+    if _, ok := names[id]; !ok || joined[op.Name] {
+      continue
+    }
+    task := op.Labels["wdl-task-name"]
+    if alias := op.Labels["wdl-call-alias"]; alias != "" {
+      task = alias
+    }
+    row := cromwellShardRow{
+      Workflow: id,
+      Task: task,
+      Shard: -1,
+      Unlisted: true,
+      Status: op.Status(),
+      Op: op.Name,
+      Unknown: op.Cost.Unknown(),
+    }
+    if !row.Unknown {
+      row.Cost = op.Cost
+    }
+    shards = append(shards, row)
+  }
+
+  type taskKey struct {
+    workflow, task string
+  }
+  tasks := map[taskKey]*cromwellTaskRow{}
+  taskShards := map[taskKey]map[int]bool{}
+  wfRows := map[string]*cromwellWorkflowRow{}
+  for id, row := range names {
+    row := row
+    wfRows[id] = &row
+  }
+
+  for _, s := range shards {
+    k := taskKey{s.Workflow, s.Task}
+    t, ok := tasks[k]
+    if !ok {
+      t = &cromwellTaskRow{Workflow: s.Workflow, Task: s.Task}
+      tasks[k] = t
+      taskShards[k] = map[int]bool{}
+    }
+    taskShards[k][s.Shard] = true
+    t.Shards = len(taskShards[k])
+
+    wf := wfRows[s.Workflow]
+    t.Calls++
+    wf.Calls++
+    t.Cost = t.Cost.Add(s.Cost)
+    wf.Cost = wf.Cost.Add(s.Cost)
+    if s.Cached {
+      t.CacheHits++
+      wf.CacheHits++
+    }
+    if s.Unknown {
+      t.Unknown++
+      wf.Unknown++
+    }
+  }
+
+  for _, wf := range wfRows {
+    report.Workflows = append(report.Workflows, *wf)
+  }
+  sort.Slice(report.Workflows, func(i, j int) bool {
+    a, b := report.Workflows[i], report.Workflows[j]
+    if c := a.Cost.Cmp(b.Cost); c != 0 {
+      return c > 0
+    }
+    return a.ID < b.ID
+  })
+
+  for _, t := range tasks {
+    report.Tasks = append(report.Tasks, *t)
+  }
+  sort.Slice(report.Tasks, func(i, j int) bool {
+    a, b := report.Tasks[i], report.Tasks[j]
+    if c := a.Cost.Cmp(b.Cost); c != 0 {
+      return c > 0
+    }
+    return a.Workflow + a.Task < b.Workflow + b.Task
+  })
+
+  sort.Slice(shards, func(i, j int) bool {
+    a, b := shards[i], shards[j]
+    if a.Workflow != b.Workflow {
+      return a.Workflow < b.Workflow
+    }
+    if a.Task != b.Task {
+      return a.Task < b.Task
+    }
+    if a.Shard != b.Shard {
+      return a.Shard < b.Shard
+    }
+    return a.Attempt < b.Attempt
+  })
+  report.Shards = shards
+  return report
+}
+
+var cromwellTpl = newPage("cromwell")
@@ -0,0 +1,238 @@
+package hello
+
+import (
+  "encoding/csv"
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// exchangeRate is how many units of a currency one US dollar buys,
+// from a date until the next rate for the currency.
+type exchangeRate struct {
+  From time.Time
+  Rate float64
+}
+
+// exchangeRates holds the rates of each currency, oldest first.
+type exchangeRates map[string][]exchangeRate
+
+// currencyConfig is read from the environment:
+//
+//   EXCHANGE_RATES        currency=rate pairs used at any date, e.g. "EUR=0.92,GBP=0.79"
+//   EXCHANGE_RATES_FILES  comma-separated paths or globs of CSV files of dated
+//                         rates, with date,currency,rate rows, e.g. "2018-01-02,EUR,0.8312"
+//   USER_CURRENCIES       email=currency pairs picking a user's default currency,
+//                         looked up like AUTH_ROLES
+//
+// Rates are units of the currency per US dollar, which prices are in.
+// Dated rates take over from EXCHANGE_RATES from their date on.
+type currencyConfig struct {
+  Rates exchangeRates
+  UserCurrencies map[string]string
+}
+
+var currencyConf currencyConfig
+
+func init() {
+  var err error
+  currencyConf, err = loadCurrencyConfig()
+  if err != nil {
+    panic(err)
+  }
+}
+
+func loadCurrencyConfig() (currencyConfig, error) {
+  c := currencyConfig{Rates: exchangeRates{}}
+
+  static, err := parsePairs(os.Getenv("EXCHANGE_RATES"))
+  if err != nil {
+    return c, fmt.Errorf("EXCHANGE_RATES: %s", err)
+  }
+  for currency, s := range static {
+    rate, err := strconv.ParseFloat(s, 64)
+    if err != nil || rate <= 0 {
+      return c, fmt.Errorf("EXCHANGE_RATES: bad rate %q for %s", s, currency)
+    }
+    c.Rates.add(currency, exchangeRate{Rate: rate})
+  }
+
+  for _, pattern := range strings.Split(os.Getenv("EXCHANGE_RATES_FILES"), ",") {
+    pattern = strings.TrimSpace(pattern)
+    if pattern == "" {
+      continue
+    }
+    paths, err := filepath.Glob(pattern)
+    if err != nil {
+      return c, err
+    }
+    for _, p := range paths {
+      f, err := os.Open(p)
+      if err != nil {
+        return c, err
+      }
+      err = readExchangeRates(f, c.Rates)
+      f.Close()
+      if err != nil {
+        return c, fmt.Errorf("%s: %s", p, err)
+      }
+    }
+  }
+  for _, rates := range c.Rates {
+    sort.Slice(rates, func(i, j int) bool {
+      return rates[i].From.Before(rates[j].From)
+    })
+  }
+
+  users, err := parsePairs(os.Getenv("USER_CURRENCIES"))
+  if err != nil {
+    return c, fmt.Errorf("USER_CURRENCIES: %s", err)
+  }
+  c.UserCurrencies = map[string]string{}
+  for email, currency := range users {
+    currency = strings.ToUpper(currency)
+    if !c.valid(currency) {
+      return c, fmt.Errorf("USER_CURRENCIES: no exchange rate for %s", currency)
+    }
+    c.UserCurrencies[email] = currency
+  }
+  return c, nil
+}
+
+func (r exchangeRates) add(currency string, rate exchangeRate) {
+  currency = strings.ToUpper(strings.TrimSpace(currency))
+  r[currency] = append(r[currency], rate)
+}
+
+// readExchangeRates reads a CSV file of date,currency,rate rows.
+// A header row is skipped.
+func readExchangeRates(f io.Reader, rates exchangeRates) error {
+  rows, err := csv.NewReader(f).ReadAll()
+  if err != nil {
+    return err
+  }
+  for i, row := range rows {
+    if len(row) != 3 {
+      return fmt.Errorf("line %d: expected date,currency,rate", i + 1)
+    }
+    from, err := time.Parse("2006-01-02", strings.TrimSpace(row[0]))
+    if err != nil {
+      if i == 0 {
+        continue
+      }
+      return fmt.Errorf("line %d: bad date %q", i + 1, row[0])
+    }
+    rate, err := strconv.ParseFloat(strings.TrimSpace(row[2]), 64)
+    if err != nil || rate <= 0 {
+      return fmt.Errorf("line %d: bad rate %q", i + 1, row[2])
+    }
+    rates.add(row[1], exchangeRate{From: from, Rate: rate})
+  }
+  return nil
+}
+
+// rate returns how many units of a currency one US dollar bought at a
+// time. Times before a currency's first dated rate use that rate.
+func (r exchangeRates) rate(currency string, at time.Time) (float64, bool) {
+  if currency == "USD" || currency == "" {
+    return 1, true
+  }
+  rates := r[currency]
+  if len(rates) == 0 {
+    return 0, false
+  }
+  rate := rates[0].Rate
+  for _, er := range rates[1:] {
+    if er.From.After(at) {
+      break
+    }
+    rate = er.Rate
+  }
+  return rate, true
+}
+
+// convert converts an amount to a currency at the rates in effect at a
+// time. It's unknown if either currency has no rate.
+func (r exchangeRates) convert(m money, currency string, at time.Time) money {
+  if m.Unknown() || m.Currency() == currency {
+    return m
+  }
+  from, ok := r.rate(m.Currency(), at)
+  if !ok {
+    return unknownMoney
+  }
+  to, ok := r.rate(currency, at)
+  if !ok {
+    return unknownMoney
+  }
+  return m.exchange(currency, to / from)
+}
+
+// currencies lists the currencies amounts can be shown in, USD first.
+func (c currencyConfig) currencies() []string {
+  var list []string
+  for currency := range c.Rates {
+    if currency != "USD" {
+      list = append(list, currency)
+    }
+  }
+  sort.Strings(list)
+  return append([]string{"USD"}, list...)
+}
+
+func (c currencyConfig) valid(currency string) bool {
+  _, ok := c.Rates.rate(currency, time.Time{})
+  return ok && currency != ""
+}
+
+// userCurrency looks up a user's default currency by exact email, then
+// by "*@domain", then by "*".
+func (c currencyConfig) userCurrency(email string) string {
+  if cur, ok := c.UserCurrencies[email]; ok {
+    return cur
+  }
+  if i := strings.LastIndex(email, "@"); i != -1 {
+    if cur, ok := c.UserCurrencies["*" + email[i:]]; ok {
+      return cur
+    }
+  }
+  if cur, ok := c.UserCurrencies["*"]; ok {
+    return cur
+  }
+  return "USD"
+}
+
+// requestCurrency returns the currency to show amounts in: the "currency"
+// query parameter, the one remembered in a cookie, or the user's default.
+func requestCurrency(r *http.Request) string {
+  if q := strings.ToUpper(r.URL.Query().Get("currency")); currencyConf.valid(q) {
+    return q
+  }
+  if c, err := r.Cookie("currency"); err == nil && currencyConf.valid(c.Value) {
+    return c.Value
+  }
+  u, _ := currentUser(r)
+  return currencyConf.userCurrency(u.Email)
+}
+
+// convertOps returns copies of operations with their prices and costs
+// converted to a currency at the rate of the day they started.
+func convertOps(ops []tplOp, currency string) []tplOp {
+  var out []tplOp
+  for _, op := range ops {
+    at := op.StartTime
+    if at.IsZero() {
+      at = op.CreateTime
+    }
+    op.Hourly = currencyConf.Rates.convert(op.Hourly, currency, at)
+    op.Cost = currencyConf.Rates.convert(op.Cost, currency, at)
+    out = append(out, op)
+  }
+  return out
+}
@@ -0,0 +1,367 @@
+package hello
+
+import (
+  "encoding/csv"
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/egress", requireRole(roleFinance, egressHandler))
+}
+
+const bytesPerGB = 1 << 30
+
+// Egress classes, from cheapest to most expensive.
+const (
+  egressSameLocation = "same location"
+  egressInterRegion = "inter-region"
+  egressInterContinent = "inter-continent"
+  egressInternet = "internet"
+)
+
+// egressRow is the estimated egress of one output of an operation.
+type egressRow struct {
+  Name string
+  Zone string
+  Output string
+  // Destination is the bucket location, or "internet".
+  Destination string
+  Class string
+  // Bytes is -1 when the size of the output isn't known.
+  Bytes int64
+  Cost money
+  Known bool
+  Error string
+}
+
+func egressHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  locations, err := parsePairs(os.Getenv("BUCKET_LOCATIONS"))
+  if err != nil {
+    fmt.Fprintln(w, "BUCKET_LOCATIONS:", err.Error())
+    return
+  }
+  api, err := newGCSClient(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+  gcs := staticBucketLocations{locations, api}
+
+  sizes := map[string]int64{}
+  if path := os.Getenv("EGRESS_MANIFEST"); path != "" {
+    sizes, err = loadSizeManifest(path)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
+      return
+    }
+  }
+
+  rows := estimateEgress(ops, gcs, sizes, requestCurrency(r))
+  totals := map[string]money{}
+  var total money
+  var bytes int64
+  for _, row := range rows {
+    totals[row.Class] = totals[row.Class].Add(row.Cost)
+    total = total.Add(row.Cost)
+    if row.Bytes > 0 {
+      bytes += row.Bytes
+    }
+  }
+
+  err = render(w, r, egressTpl, "Egress", struct {
+    Project string
+    Rows []egressRow
+    Totals map[string]money
+    Total money
+    Bytes int64
+    HaveSizes bool
+  }{
+    Project: project,
+    Rows: rows,
+    Totals: totals,
+    Total: total,
+    Bytes: bytes,
+    HaveSizes: len(sizes) != 0,
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// estimateEgress classifies every output of every operation by where the
+// data goes relative to the VM, and prices it if its size is known.
+// Sizes are looked up by output path, then by operation name, in which case
+// the operation's size is split evenly between its outputs.
+//
+// Inter-continent and internet egress are priced with the monthly tiers,
+// so operations are priced in the order they ran. Each operation is priced
+// with the price list in effect when it started, and converted to currency
+// at the rate of that day.
+func estimateEgress(ops []tplOp, gcs gcsClient, sizes map[string]int64, currency string) []egressRow {
+  sorted := append([]tplOp(nil), ops...)
+  sort.Slice(sorted, func(i, j int) bool {
+    return sorted[i].StartTime.Before(sorted[j].StartTime)
+  })
+
+  // Cumulative GB by month and tier price key.
+  usage := map[string]float64{}
+
+  var rows []egressRow
+  for _, op := range sorted {
+    outputs := op.Request.PipelineArgs.Outputs
+    if len(outputs) == 0 {
+      continue
+    }
+    zone, _ := splitMachineType(op.GCE.MachineType)
+    if op.GCE.Zone != "" {
+      zone = op.GCE.Zone
+    }
+    opBytes, haveOpBytes := lookupOpSize(sizes, op.Name)
+
+    var paths []string
+    for _, p := range outputs {
+      paths = append(paths, p)
+    }
+    sort.Strings(paths)
+
+    for _, p := range paths {
+      row := egressRow{Name: op.Name, Zone: zone, Output: p, Bytes: -1}
+
+      if zone == "" {
+        row.Error = "unknown VM zone"
+        rows = append(rows, row)
+        continue
+      }
+
+      if bucket, _, ok := parseGCSPath(p); ok {
+        loc, err := gcs.BucketLocation(bucket)
+        if err != nil {
+          row.Error = err.Error()
+          rows = append(rows, row)
+          continue
+        }
+        row.Destination = loc
+        row.Class = egressClass(regionOf(zone), loc)
+      } else {
+        row.Destination = "internet"
+        row.Class = egressInternet
+      }
+
+      if b, ok := sizes[p]; ok {
+        row.Bytes = b
+      } else if haveOpBytes {
+        row.Bytes = opBytes / int64(len(paths))
+      }
+
+      if row.Bytes >= 0 {
+        gb := float64(row.Bytes) / bytesPerGB
+        catalog := catalogAt(op.StartTime)
+        switch row.Class {
+        case egressSameLocation:
+          row.Known = true
+        case egressInterRegion:
+          rate, ok := catalog.flatPrice("CP-COMPUTEENGINE-INTERNET-EGRESS-REGION", "us")
+          row.Cost = currencyConf.Rates.convert(usd(gb * rate), currency, op.StartTime)
+          row.Known = ok
+        default:
+          key := internetEgressKey(row.Destination)
+          tiers := catalog.tieredPrices(key)
+          usageKey := op.StartTime.Format("2006-01") + " " + key
+          row.Cost = currencyConf.Rates.convert(usd(tiers.cost(usage[usageKey], gb)), currency, op.StartTime)
+          row.Known = len(tiers) != 0
+          usage[usageKey] += gb
+        }
+      }
+      rows = append(rows, row)
+    }
+  }
+  return rows
+}
+
+// egressClass compares a VM region with a bucket location, which may be a
+// region ("US-CENTRAL1"), a dual-region ("NAM4") or a multi-region ("US").
+func egressClass(vmRegion, location string) string {
+  location = strings.ToLower(location)
+  if location == vmRegion {
+    return egressSameLocation
+  }
+  if continentOf(location) != continentOf(vmRegion) {
+    return egressInterContinent
+  }
+  // Multi- and dual-region buckets are free to reach from any
+  // region in the same continent.
+  if !strings.Contains(location, "-") {
+    return egressSameLocation
+  }
+  return egressInterRegion
+}
+
+// continentOf maps a region or bucket location to the continent used
+// for egress pricing.
+func continentOf(location string) string {
+  location = strings.ToLower(location)
+  prefix := strings.SplitN(location, "-", 2)[0]
+  switch {
+  case prefix == "us" || prefix == "northamerica" || prefix == "nam4":
+    return "na"
+  case prefix == "southamerica":
+    return "sa"
+  case prefix == "eu" || prefix == "europe" || prefix == "eur4":
+    return "eu"
+  case prefix == "australia":
+    return "au"
+  case prefix == "asia":
+    return "apac"
+  }
+  return prefix
+}
+
+// internetEgressKey picks the tiered price list for traffic to a destination.
+// Internet destinations are unknown, so they get the worldwide price.
+func internetEgressKey(destination string) string {
+  switch continentOf(destination) {
+  case "au":
+    return "CP-COMPUTEENGINE-INTERNET-EGRESS-AU-AU"
+  case "apac":
+    return "CP-COMPUTEENGINE-INTERNET-EGRESS-APAC-APAC"
+  }
+  return "CP-COMPUTEENGINE-INTERNET-EGRESS-NA-NA"
+}
+
+// priceTier is the price per unit up to Limit units a month.
+type priceTier struct {
+  Limit float64
+  Rate float64
+}
+
+type priceTiers []priceTier
+
+// tieredPrices reads the "tiers" of a price list entry, in order.
+func (c *priceCatalog) tieredPrices(key string) priceTiers {
+  entry, _ := c.PriceList[key].(map[string]interface{})
+  raw, _ := entry["tiers"].(map[string]interface{})
+  var tiers priceTiers
+  for limit, rate := range raw {
+    l, err := strconv.ParseFloat(limit, 64)
+    if err != nil {
+      continue
+    }
+    r, _ := rate.(float64)
+    tiers = append(tiers, priceTier{l, r})
+  }
+  sort.Slice(tiers, func(i, j int) bool { return tiers[i].Limit < tiers[j].Limit })
+  return tiers
+}
+
+// cost prices amount units, given that used units were already used this
+// month. Usage beyond the last tier is priced at the last tier's rate.
+func (t priceTiers) cost(used, amount float64) float64 {
+  var cost float64
+  from := used
+  to := used + amount
+  lower := 0.0
+  for i, tier := range t {
+    upper := tier.Limit
+    if i == len(t) - 1 {
+      upper = to
+    }
+    if from < upper && to > lower {
+      cost += (minFloat(to, upper) - maxFloat(from, lower)) * tier.Rate
+    }
+    lower = upper
+  }
+  return cost
+}
+
+// flatPrice reads a single-rate price list entry for a price region.
+func (c *priceCatalog) flatPrice(key, region string) (float64, bool) {
+  entry, _ := c.PriceList[key].(map[string]interface{})
+  rate, ok := entry[region].(float64)
+  return rate, ok
+}
+
+func minFloat(a, b float64) float64 {
+  if a < b {
+    return a
+  }
+  return b
+}
+
+func maxFloat(a, b float64) float64 {
+  if a > b {
+    return a
+  }
+  return b
+}
+
+// loadSizeManifest reads a CSV file of "key,bytes" lines, where key is an
+// output path or an operation name. This is how sizes from logs or
+// delocalization manifests get into the dashboard.
+func loadSizeManifest(path string) (map[string]int64, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  r := csv.NewReader(f)
+  r.FieldsPerRecord = 2
+  r.Comment = '#'
+  sizes := map[string]int64{}
+  for {
+    rec, err := r.Read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, fmt.Errorf("reading size manifest %s: %s", path, err)
+    }
+    n, err := strconv.ParseInt(strings.TrimSpace(rec[1]), 10, 64)
+    if err != nil {
+      // Allow a header line.
+      continue
+    }
+    sizes[strings.TrimSpace(rec[0])] = n
+  }
+  return sizes, nil
+}
+
+// lookupOpSize finds an operation's size in a manifest, which may use the
+// full operation name or the shortened one shown on the dashboard.
+func lookupOpSize(sizes map[string]int64, name string) (int64, bool) {
+  if n, ok := sizes[name]; ok {
+    return n, true
+  }
+  for k, n := range sizes {
+    k = strings.TrimPrefix(k, "operations/")
+    if name != "" && strings.HasPrefix(k, name) {
+      return n, true
+    }
+  }
+  return 0, false
+}
+
+var egressTpl = newPage("egress")
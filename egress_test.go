@@ -0,0 +1,97 @@
+package hello
+
+import (
+  "fmt"
+  "math"
+  "testing"
+  "time"
+
+  genomics "google.golang.org/api/genomics/v1"
+)
+
+func TestEgressTiers(t *testing.T) {
+  // 0.12 up to 1 TB a month, 0.11 up to 10 TB, then 0.08.
+  tiers := currentCatalog().tieredPrices("CP-COMPUTEENGINE-INTERNET-EGRESS-NA-NA")
+  if len(tiers) != 3 || tiers[0].Limit != 1024 || tiers[2].Rate != 0.08 {
+    t.Fatalf("tiers = %+v", tiers)
+  }
+  for _, c := range []struct {
+    name string
+    used, amount float64
+    want float64
+  }{
+    {"nothing", 0, 0, 0},
+    {"first GB", 0, 1, 0.12},
+    {"up to the first limit", 0, 1024, 1024 * 0.12},
+    {"last GB of the first tier", 1023, 1, 0.12},
+    {"first GB of the second tier", 1024, 1, 0.11},
+    {"across the first limit", 1023, 2, 0.12 + 0.11},
+    {"across two limits", 1000, 10000, 24 * 0.12 + 9216 * 0.11 + 760 * 0.08},
+    {"at the last limit", 92159, 2, 0.08 * 2},
+    {"past the last limit", 200000, 10, 0.08 * 10},
+    {"all tiers", 0, 100000, 1024 * 0.12 + 9216 * 0.11 + 89760 * 0.08},
+  } {
+    if got := tiers.cost(c.used, c.amount); math.Abs(got - c.want) > 1e-9 {
+      t.Errorf("%s: cost(%v, %v) = %v, want %v", c.name, c.used, c.amount, got, c.want)
+    }
+  }
+
+  if got := currentCatalog().tieredPrices("NO-SUCH-KEY").cost(0, 10); got != 0 {
+    t.Errorf("cost without tiers = %v, want 0", got)
+  }
+}
+
+func TestEgressClass(t *testing.T) {
+  for _, c := range []struct {
+    region, location, want string
+  }{
+    {"us-central1", "US-CENTRAL1", egressSameLocation},
+    {"us-central1", "US", egressSameLocation},
+    {"us-central1", "NAM4", egressSameLocation},
+    {"us-central1", "US-EAST1", egressInterRegion},
+    {"us-central1", "EU", egressInterContinent},
+    {"europe-west1", "EUR4", egressSameLocation},
+    {"asia-east1", "AUSTRALIA-SOUTHEAST1", egressInterContinent},
+  } {
+    if got := egressClass(c.region, c.location); got != c.want {
+      t.Errorf("egressClass(%q, %q) = %q, want %q", c.region, c.location, got, c.want)
+    }
+  }
+}
+
+func TestEgressPricedAtOpTime(t *testing.T) {
+  old := priceCatalogs
+  defer func() { priceCatalogs = old }()
+  current := currentCatalog()
+  earlier := &priceCatalog{
+    Updated: current.Updated.AddDate(-1, 0, 0),
+    PriceList: map[string]interface{}{
+      "CP-COMPUTEENGINE-INTERNET-EGRESS-NA-NA": map[string]interface{}{
+        "tiers": map[string]interface{}{"1024": 0.2},
+      },
+    },
+  }
+  priceCatalogs = []*priceCatalog{earlier, current}
+
+  var ops []tplOp
+  for i, start := range []time.Time{earlier.Updated, current.Updated} {
+    op := tplOp{
+      Name: fmt.Sprint("op", i),
+      GCE: &genomics.ComputeEngine{MachineType: "us-central1-f/n1-standard-1"},
+      StartTime: start,
+    }
+    op.Request.PipelineArgs.Outputs = map[string]string{"out": fmt.Sprintf("https://example.org/%d", i)}
+    ops = append(ops, op)
+  }
+  sizes := map[string]int64{"https://example.org/0": bytesPerGB, "https://example.org/1": bytesPerGB}
+
+  rows := estimateEgress(ops, nil, sizes, "USD")
+  if len(rows) != 2 {
+    t.Fatalf("rows = %+v", rows)
+  }
+  for i, want := range []string{"0.200000", "0.120000"} {
+    if rows[i].Cost.String() != want || !rows[i].Known {
+      t.Errorf("%s: %s, known %v; want %s", rows[i].Name, rows[i].Cost, rows[i].Known, want)
+    }
+  }
+}
@@ -0,0 +1,105 @@
+package hello
+
+import (
+  "net/http"
+  "strings"
+  "time"
+)
+
+// opFilter selects operations by the fields people usually ask about.
+// Empty fields match everything.
+type opFilter struct {
+  // Machine matches machine types containing it, e.g. "highmem", and
+  // MachineType only the machine type it is, e.g. "n1-standard-1".
+  Machine string
+  MachineType string
+  // Zone matches zones starting with it, so a region matches all its zones.
+  Zone string
+  Pipeline string
+  // Label is a key=value pair the operation must be labelled with.
+  Label string
+  // Source is "live" or "imported".
+  Source string
+  From time.Time
+  To time.Time
+}
+
+// parseOpFilter reads a filter from the query parameters machine,
+// machine_type, zone, pipeline, label, source, from and to. Dates are
+// YYYY-MM-DD and "to" is inclusive.
+func parseOpFilter(r *http.Request) opFilter {
+  q := r.URL.Query()
+  f := opFilter{
+    Machine: q.Get("machine"),
+    MachineType: q.Get("machine_type"),
+    Zone: q.Get("zone"),
+    Pipeline: q.Get("pipeline"),
+    Label: q.Get("label"),
+    Source: q.Get("source"),
+  }
+  if t, err := time.Parse("2006-01-02", q.Get("from")); err == nil {
+    f.From = t
+  }
+  if t, err := time.Parse("2006-01-02", q.Get("to")); err == nil {
+    f.To = t.AddDate(0, 0, 1)
+  }
+  return f
+}
+
+func (f opFilter) match(op tplOp) bool {
+  zone, machine := splitMachineType(op.GCE.MachineType)
+  if f.Machine != "" && !strings.Contains(machine, f.Machine) {
+    return false
+  }
+  if f.MachineType != "" && machine != f.MachineType {
+    return false
+  }
+  if f.Zone != "" && !strings.HasPrefix(zone, f.Zone) {
+    return false
+  }
+  if f.Pipeline != "" && op.PipelineName() != f.Pipeline {
+    return false
+  }
+  if f.Label != "" {
+    parts := strings.SplitN(f.Label, "=", 2)
+    v, ok := op.Labels[parts[0]]
+    if !ok || (len(parts) == 2 && v != parts[1]) {
+      return false
+    }
+  }
+  if f.Source != "" && op.Source != f.Source {
+    return false
+  }
+  if !f.From.IsZero() && op.StartTime.Before(f.From) {
+    return false
+  }
+  if !f.To.IsZero() && !op.StartTime.Before(f.To) {
+    return false
+  }
+  return true
+}
+
+// FromDate and ToDate format the date range back into query parameter form.
+func (f opFilter) FromDate() string {
+  if f.From.IsZero() {
+    return ""
+  }
+  return f.From.Format("2006-01-02")
+}
+
+func (f opFilter) ToDate() string {
+  if f.To.IsZero() {
+    return ""
+  }
+  return f.To.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+func filterOps(ops []tplOp, f opFilter) []tplOp {
+  var out []tplOp
+  for _, op := range ops {
+    if f.match(op) {
+      out = append(out, op)
+    }
+  }
+  return out
+}
@@ -0,0 +1,167 @@
+package hello
+
+import (
+  "math"
+  "time"
+)
+
+// forecastWindow is how much history the forecast model is fit to.
+const forecastWindow = 28 * 24 * time.Hour
+
+// forecastResult projects the current month's spend to the end of the month.
+type forecastResult struct {
+  Month string
+  SpentSoFar money
+  // RunRate is the average daily spend over the forecast window.
+  RunRate money
+  // Weekdays holds the weekday seasonality factors, indexed by time.Weekday.
+  Weekdays [7]float64
+  Projected money
+  // Low and High bound the 95% confidence band of Projected.
+  Low money
+  High money
+  HistoryDays int
+}
+
+type weekdayFactor struct {
+  Day string
+  Factor float64
+}
+
+// WeekdayFactors lists the seasonality factors by weekday name, for display.
+func (f forecastResult) WeekdayFactors() []weekdayFactor {
+  var out []weekdayFactor
+  for d, factor := range f.Weekdays {
+    out = append(out, weekdayFactor{time.Weekday(d).String(), factor})
+  }
+  return out
+}
+
+// forecast projects month-end spend from a run rate fit to recent daily
+// spend, adjusted by how spend on each weekday differs from the average.
+// The model works in floating point, like any statistics; only its
+// results are rounded to money, in the given currency, which should be
+// the one the operations' costs are in.
+func forecast(ops []tplOp, currency string, now time.Time) forecastResult {
+  now = now.UTC()
+  today := truncateDay(now)
+  monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+  monthEnd := monthStart.AddDate(0, 1, 0)
+
+  res := forecastResult{Month: now.Format("January 2006")}
+  for d := range res.Weekdays {
+    res.Weekdays[d] = 1
+  }
+
+  daily := dailyCosts(ops)
+  var spent, runRate float64
+
+  // The history window covers whole days before today, but doesn't
+  // start before the earliest operation we know about.
+  windowStart := today.Add(-forecastWindow)
+  var earliest time.Time
+  for day, cost := range daily {
+    if !day.Before(monthStart) {
+      spent += cost
+    }
+    if earliest.IsZero() || day.Before(earliest) {
+      earliest = day
+    }
+  }
+  if earliest.After(windowStart) {
+    windowStart = earliest
+  }
+
+  var history []time.Time
+  for d := windowStart; d.Before(today); d = d.AddDate(0, 0, 1) {
+    history = append(history, d)
+  }
+  res.HistoryDays = len(history)
+  if len(history) == 0 {
+    res.SpentSoFar = newMoney(spent, currency)
+    res.Projected = newMoney(spent, currency)
+    res.Low = newMoney(spent, currency)
+    res.High = newMoney(spent, currency)
+    return res
+  }
+
+  var total float64
+  var weekdayTotal [7]float64
+  var weekdayDays [7]int
+  for _, d := range history {
+    total += daily[d]
+    weekdayTotal[d.Weekday()] += daily[d]
+    weekdayDays[d.Weekday()]++
+  }
+  runRate = total / float64(len(history))
+
+  if runRate > 0 {
+    for d := range res.Weekdays {
+      if weekdayDays[d] != 0 {
+        res.Weekdays[d] = weekdayTotal[d] / float64(weekdayDays[d]) / runRate
+      }
+    }
+  }
+
+  // The spread of daily spend around the seasonal model gives the
+  // uncertainty of each projected day.
+  var variance float64
+  if len(history) > 1 {
+    for _, d := range history {
+      r := daily[d] - runRate * res.Weekdays[d.Weekday()]
+      variance += r * r
+    }
+    variance /= float64(len(history) - 1)
+  }
+
+  // What's left of today, then each remaining day of the month.
+  tomorrow := today.AddDate(0, 0, 1)
+  left := float64(tomorrow.Sub(now)) / float64(24 * time.Hour)
+  projected := runRate * res.Weekdays[today.Weekday()] * left
+  days := left
+  for d := tomorrow; d.Before(monthEnd); d = d.AddDate(0, 0, 1) {
+    projected += runRate * res.Weekdays[d.Weekday()]
+    days++
+  }
+
+  band := 1.96 * math.Sqrt(variance * days)
+  res.SpentSoFar = newMoney(spent, currency)
+  res.RunRate = newMoney(runRate, currency)
+  res.Projected = newMoney(spent + projected, currency)
+  res.Low = newMoney(math.Max(spent, spent + projected - band), currency)
+  res.High = newMoney(spent + projected + band, currency)
+  return res
+}
+
+// dailyCosts spreads the cost of each operation over the UTC days it
+// ran on, in proportion to how long it ran on each day. It's meant for
+// statistics, so costs are floating point dollars.
+func dailyCosts(ops []tplOp) map[time.Time]float64 {
+  daily := map[time.Time]float64{}
+  for _, op := range ops {
+    if op.Cost.Unknown() || op.Duration <= 0 {
+      continue
+    }
+    cost := op.Cost.Float()
+    start := op.StartTime.UTC()
+    end := start.Add(op.Duration)
+
+    for day := truncateDay(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+      from := start
+      if day.After(from) {
+        from = day
+      }
+      to := day.AddDate(0, 0, 1)
+      if end.Before(to) {
+        to = end
+      }
+      daily[day] += cost * float64(to.Sub(from)) / float64(op.Duration)
+    }
+  }
+  return daily
+}
+
+func truncateDay(t time.Time) time.Time {
+  t = t.UTC()
+  return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,232 @@
+package hello
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  "golang.org/x/oauth2/google"
+)
+
+// gcsClient is the part of the Cloud Storage JSON API the dashboard uses.
+// It's an interface so the API can be replaced by imported data.
+type gcsClient interface {
+  BucketLocation(bucket string) (string, error)
+  ListObjects(bucket, prefix string) ([]gcsObject, error)
+}
+
+type gcsObject struct {
+  Bucket string
+  Name string
+  Size int64
+  // StorageClass is empty when the listing doesn't say,
+  // e.g. when it was imported from "gsutil ls -l".
+  StorageClass string
+  Updated time.Time
+}
+
+// Path returns the object's gs:// URL.
+func (o gcsObject) Path() string {
+  return "gs://" + o.Bucket + "/" + o.Name
+}
+
+const gcsReadOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// gcsAPI talks to the Cloud Storage JSON API.
+type gcsAPI struct {
+  client *http.Client
+  // locations caches bucket locations for the life of a request.
+  locations map[string]string
+}
+
+func newGCSClient(ctx context.Context) (gcsClient, error) {
+  client, err := google.DefaultClient(ctx, gcsReadOnlyScope)
+  if err != nil {
+    return nil, err
+  }
+  return &gcsAPI{client: client, locations: map[string]string{}}, nil
+}
+
+func (g *gcsAPI) get(path string, v interface{}) error {
+  resp, err := g.client.Get("https://www.googleapis.com/storage/v1/" + path)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("storage API %s: %s", path, resp.Status)
+  }
+  return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (g *gcsAPI) BucketLocation(bucket string) (string, error) {
+  if loc, ok := g.locations[bucket]; ok {
+    return loc, nil
+  }
+  var b struct {
+    Location string
+  }
+  err := g.get("b/" + url.PathEscape(bucket) + "?fields=location", &b)
+  if err != nil {
+    return "", err
+  }
+  g.locations[bucket] = b.Location
+  return b.Location, nil
+}
+
+func (g *gcsAPI) ListObjects(bucket, prefix string) ([]gcsObject, error) {
+  var objects []gcsObject
+  pageToken := ""
+  for {
+    q := url.Values{}
+    q.Set("prefix", prefix)
+    q.Set("fields", "items(name,size,storageClass,updated),nextPageToken")
+    if pageToken != "" {
+      q.Set("pageToken", pageToken)
+    }
+
+    var page struct {
+      Items []struct {
+        Name string
+        Size string
+        StorageClass string
+        Updated time.Time
+      }
+      NextPageToken string
+    }
+    err := g.get("b/" + url.PathEscape(bucket) + "/o?" + q.Encode(), &page)
+    if err != nil {
+      return nil, err
+    }
+
+    for _, item := range page.Items {
+      size, _ := strconv.ParseInt(item.Size, 10, 64)
+      objects = append(objects, gcsObject{
+        Bucket: bucket,
+        Name: item.Name,
+        Size: size,
+        StorageClass: item.StorageClass,
+        Updated: item.Updated,
+      })
+    }
+
+    if page.NextPageToken == "" {
+      return objects, nil
+    }
+    pageToken = page.NextPageToken
+  }
+}
+
+// staticBucketLocations answers from a fixed bucket=location list, as found
+// in the BUCKET_LOCATIONS environment variable, and asks the next client
+// about any other bucket. The next client may be nil.
+type staticBucketLocations struct {
+  locations map[string]string
+  next gcsClient
+}
+
+func (s staticBucketLocations) BucketLocation(bucket string) (string, error) {
+  if loc, ok := s.locations[bucket]; ok {
+    return loc, nil
+  }
+  if s.next == nil {
+    return "", fmt.Errorf("unknown location for bucket %s", bucket)
+  }
+  return s.next.BucketLocation(bucket)
+}
+
+func (s staticBucketLocations) ListObjects(bucket, prefix string) ([]gcsObject, error) {
+  if s.next == nil {
+    return nil, fmt.Errorf("no listing for bucket %s", bucket)
+  }
+  return s.next.ListObjects(bucket, prefix)
+}
+
+// importedListing answers from a bucket listing saved with "gsutil ls -l",
+// and asks the next client about bucket locations. The next client may be nil.
+type importedListing struct {
+  objects []gcsObject
+  next gcsClient
+}
+
+func (l importedListing) BucketLocation(bucket string) (string, error) {
+  if l.next == nil {
+    return "", fmt.Errorf("unknown location for bucket %s", bucket)
+  }
+  return l.next.BucketLocation(bucket)
+}
+
+func (l importedListing) ListObjects(bucket, prefix string) ([]gcsObject, error) {
+  var objects []gcsObject
+  for _, o := range l.objects {
+    if o.Bucket == bucket && strings.HasPrefix(o.Name, prefix) {
+      objects = append(objects, o)
+    }
+  }
+  return objects, nil
+}
+
+// loadGsutilListing reads the output of "gsutil ls -l", which has lines like
+//
+//   1234  2018-01-02T03:04:05Z  gs://bucket/path/to/object
+//
+// followed by a TOTAL line, which is skipped along with anything else
+// that doesn't look like an object.
+func loadGsutilListing(path string) ([]gcsObject, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  var objects []gcsObject
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) != 3 {
+      continue
+    }
+    size, err := strconv.ParseInt(fields[0], 10, 64)
+    if err != nil {
+      continue
+    }
+    bucket, name, ok := parseGCSPath(fields[2])
+    if !ok || name == "" {
+      continue
+    }
+    updated, _ := time.Parse(time.RFC3339, fields[1])
+    objects = append(objects, gcsObject{
+      Bucket: bucket,
+      Name: name,
+      Size: size,
+      Updated: updated,
+    })
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, fmt.Errorf("reading bucket listing %s: %s", path, err)
+  }
+  return objects, nil
+}
+
+// parseGCSPath splits "gs://bucket/some/object" into bucket and object.
+func parseGCSPath(p string) (bucket, object string, ok bool) {
+  if !strings.HasPrefix(p, "gs://") {
+    return "", "", false
+  }
+  p = strings.TrimPrefix(p, "gs://")
+  parts := strings.SplitN(p, "/", 2)
+  if parts[0] == "" {
+    return "", "", false
+  }
+  if len(parts) == 2 {
+    object = parts[1]
+  }
+  return parts[0], object, true
+}
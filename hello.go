@@ -1,82 +1,271 @@
 package hello
 
 import (
+    "context"
+    "errors"
     "fmt"
     "net/http"
-    "text/template"
     "time"
     "strings"
     "golang.org/x/oauth2/google"
     "google.golang.org/api/genomics/v1"
     "google.golang.org/appengine"
-    "encoding/json"
     "os"
+    "sort"
 )
 
 func init() {
-    http.HandleFunc("/", handler)
+    http.HandleFunc("/", requireRole(roleViewer, handler))
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
     ctx := appengine.NewContext(r)
 
-    project := os.Getenv("PROJECT")
-
-    if project == "" {
-      project = appengine.AppID(ctx)
+    project, err := getProject(ctx)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
+      return
     }
 
-    if project == "None" {
-      fmt.Fprintln(w, "no project found")
+    tplOps, pendingOps, err := listOps(ctx, project)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
       return
     }
 
-    client, err := google.DefaultClient(ctx, genomics.GenomicsScope)
+    budgets, err := parseBudgetAlerts(os.Getenv("BUDGET_ALERTS"))
     if err != nil {
       fmt.Fprintln(w, err.Error())
       return
     }
 
-    svc, err := genomics.New(client)
+    // Budgets are in USD, like prices, whatever currency the page is in.
+    fc := forecast(tplOps, "USD", time.Now())
+    alerts := checkBudgets(budgets, fc)
+    regConf, err := loadRegressionConfig()
     if err != nil {
       fmt.Fprintln(w, err.Error())
       return
     }
+    alerts = append(alerts, checkRegressions(findRegressions(tplOps, regConf))...)
+    logAlerts(ctx, alerts)
 
+    // Operations are shown at the prices in effect when they ran, or with
+    // "prices=current", at today's prices for comparison.
+    currency := requestCurrency(r)
+    historical := convertOps(tplOps, currency)
+    current := convertOps(atCurrentPrices(tplOps), currency)
+    shown := historical
+    if r.URL.Query().Get("prices") == "current" {
+      shown = current
+    }
 
-    w.Header().Add("content-type", "text/html")
-
-    ops := genomics.NewOperationsService(svc)
-    resp, err := ops.List("operations").Filter("projectId = " + project).Do()
+    err = render(w, r, tpl, "Operations", struct {
+      Ops []tplOp
+      Totals opTotals
+      AtCurrentPrices bool
+      HistoricalTotals opTotals
+      CurrentTotals opTotals
+      CurrentVersion string
+      Pending []tplOp
+      QueueStats []queueStat
+      Forecast forecastResult
+      Alerts []alert
+      Prices map[string]float64
+      Project string
+    }{
+      Ops: shown,
+      Totals: totalOps(shown),
+      AtCurrentPrices: r.URL.Query().Get("prices") == "current",
+      HistoricalTotals: totalOps(historical),
+      CurrentTotals: totalOps(current),
+      CurrentVersion: currentCatalog().Version,
+      Pending: convertOps(pendingOps, currency),
+      QueueStats: queueStats(tplOps),
+      Forecast: forecast(historical, currency, time.Now()),
+      Alerts: alerts,
+      Prices: hourlyVMPrices,
+      Project: project,
+    })
     if err != nil {
       fmt.Fprintln(w, err.Error())
       return
     }
+}
 
-    var tplOps []tplOp
+// getProject returns the Google Cloud project whose operations are shown,
+// from the PROJECT environment variable or the App Engine app ID.
+func getProject(ctx context.Context) (string, error) {
+    project := os.Getenv("PROJECT")
 
-    for _, op := range resp.Operations {
+    if project == "" {
+      project = appengine.AppID(ctx)
+    }
 
-      meta := genomics.OperationMetadata{}
-      err := json.Unmarshal(op.Metadata, &meta)
+    if project == "None" {
+      return "", errors.New("no project found")
+    }
+    return project, nil
+}
+
+// listOps lists operations like listSourceOps, with the allocation
+// rules applied to their labels.
+func listOps(ctx context.Context, project string) ([]tplOp, []tplOp, error) {
+    tplOps, pendingOps, err := listSourceOps(ctx, project)
+    if err != nil {
+      return nil, nil, err
+    }
+    return allocConf.apply(tplOps), allocConf.apply(pendingOps), nil
+}
+
+// listSourceOps fetches the project's pipeline operations, the tasks of the
+// TES server in TES_URL if there is one, and any imported run records,
+// and computes their cost.
+// Operations which haven't started yet are returned separately.
+func listSourceOps(ctx context.Context, project string) ([]tplOp, []tplOp, error) {
+    recs, err := listGenomicsOps(ctx, project)
+    if err != nil {
+      return nil, nil, err
+    }
+
+    if u := os.Getenv("TES_URL"); u != "" {
+      tasks, err := tesClient{URL: u}.listTasks()
       if err != nil {
-        fmt.Fprintln(w, err.Error())
-        return
+        return nil, nil, err
       }
+      recs = append(recs, tesRecords(tasks)...)
+    }
 
-      if meta.StartTime == "" {
+    if patterns := os.Getenv("IMPORTED_RUNS"); patterns != "" {
+      imported, err := loadImportedRuns(patterns, os.Getenv("IMPORTED_ZONE"))
+      if err != nil {
+        return nil, nil, err
+      }
+      recs = append(recs, imported...)
+    }
+
+    tplOps, pendingOps := priceOps(recs, time.Now())
+    return tplOps, pendingOps, nil
+}
+
+// listGenomicsOps fetches the project's operations from the Genomics API,
+// and from the Life Sciences API if it's configured.
+func listGenomicsOps(ctx context.Context, project string) ([]opRecord, error) {
+    client, err := google.DefaultClient(ctx, genomics.GenomicsScope)
+    if err != nil {
+      return nil, err
+    }
+
+    svc, err := genomics.New(client)
+    if err != nil {
+      return nil, err
+    }
+
+    // Operations are listed a page at a time.
+    var listed []*genomics.Operation
+    call := genomics.NewOperationsService(svc).List("operations").Filter("projectId = " + project)
+    for token := ""; ; {
+      resp, err := call.PageToken(token).Do()
+      if err != nil {
+        return nil, err
+      }
+      listed = append(listed, resp.Operations...)
+      token = resp.NextPageToken
+      if token == "" {
+        break
+      }
+    }
+
+    lifeSciencesOps, err := listLifeSciencesOps(ctx, project)
+    if err != nil {
+      return nil, err
+    }
+
+    var recs []opRecord
+    for _, op := range append(listed, lifeSciencesOps...) {
+      rec, err := decodeOperation(op)
+      if err != nil {
+        return nil, err
+      }
+      recs = append(recs, rec)
+    }
+    return recs, nil
+}
+
+// priceOps computes the run time and cost of operations, whichever
+// source they came from.
+func priceOps(recs []opRecord, now time.Time) ([]tplOp, []tplOp) {
+    var tplOps []tplOp
+    var pendingOps []tplOp
+
+    for _, rec := range recs {
+
+      // Sources which don't say when an operation was created
+      // can't say how long it waited either.
+      created := rec.CreateTime
+      if created.IsZero() {
+        created = rec.StartTime
+      }
+      if created.IsZero() {
+        created = now
+      }
+
+      // Operations without a start time are still waiting for a VM,
+      // so the only interesting thing about them is how long they've waited.
+      if rec.StartTime.IsZero() && !rec.Done {
+        gce := rec.GCE
+        pendingOps = append(pendingOps, tplOp{
+          Name: shortOpName(rec.Name),
+          API: rec.API,
+          Source: rec.Source,
+          Labels: rec.Labels,
+          Request: rec.Request,
+          RawRequest: rec.RawRequest,
+          RawRuntime: rec.RawRuntime,
+          GCE: &gce,
+          CreateTime: rec.CreateTime,
+          QueueWait: now.Sub(created),
+          Pending: true,
+        })
+        continue
+      }
+
+      // Operations which finished without ever getting a VM, e.g. because
+      // of a quota or a bad image, failed and cost nothing.
+      if rec.StartTime.IsZero() {
+        errMsg := rec.Error
+        if errMsg == "" {
+          errMsg = "finished without starting a VM"
+        }
+        gce := rec.GCE
+        wait := time.Duration(0)
+        if !rec.EndTime.IsZero() {
+          wait = rec.EndTime.Sub(created)
+        }
+        tplOps = append(tplOps, tplOp{
+          Name: shortOpName(rec.Name),
+          API: rec.API,
+          Source: rec.Source,
+          Labels: rec.Labels,
+          Request: rec.Request,
+          RawRequest: rec.RawRequest,
+          RawRuntime: rec.RawRuntime,
+          Done: true,
+          Error: errMsg,
+          GCE: &gce,
+          Cost: usd(0),
+          CreateTime: rec.CreateTime,
+          QueueWait: wait,
+        })
         continue
       }
-      startTime, _ := time.Parse(time.RFC3339, meta.StartTime)
 
-      var endTime time.Time
-      if meta.EndTime == "" {
-        endTime = time.Now()
-      } else {
-        endTime, _ = time.Parse(time.RFC3339, meta.EndTime)
+      endTime := rec.EndTime
+      if endTime.IsZero() {
+        endTime = now
       }
 
-      dur := endTime.Sub(startTime)
+      dur := endTime.Sub(rec.StartTime)
 
       // GCE bills at a minimum of 1 minute
       if dur < time.Minute {
@@ -85,153 +274,307 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
       hours := float64(dur) / float64(time.Hour)
 
-      runtime := genomics.RuntimeMetadata{}
-      json.Unmarshal(meta.RuntimeMetadata, &runtime)
-      gce := runtime.ComputeEngine
-      hourly, ok := hourlyVMPrices[gce.MachineType]
+      // Operations are priced at the price list in effect when they started.
+      gce := rec.GCE
+      price, ok := catalogAt(rec.StartTime).vmPrice(gce.MachineType)
+      hourly := price.Hourly
 
-      cost := ""
-      if !ok {
-        cost = "unknown"
-      } else {
-        cost = fmt.Sprintf("%f", hours * hourly)
+      cost := unknownMoney
+      if ok {
+        cost = hourly.Mul(hours)
       }
 
       tplOps = append(tplOps, tplOp{
-        Name: strings.TrimPrefix(op.Name, "operations/")[:10],
-        Meta: meta,
-        GCE: gce,
+        Name: shortOpName(rec.Name),
+        API: rec.API,
+        Source: rec.Source,
+        Labels: rec.Labels,
+        Request: rec.Request,
+        RawRequest: rec.RawRequest,
+        RawRuntime: rec.RawRuntime,
+        Done: rec.Done,
+        Error: rec.Error,
+        GCE: &gce,
         Duration: dur,
         Hourly: hourly,
+        PriceRegion: price.Region,
+        FallbackPrice: price.Fallback,
+        PriceVersion: price.Version,
         Hours: hours,
         Cost: cost,
+        CreateTime: rec.CreateTime,
+        StartTime: rec.StartTime,
+        QueueWait: rec.StartTime.Sub(created),
       })
     }
-
-    err = tpl.Execute(w, struct {
-      Ops []tplOp
-      Prices map[string]float64
-      Project string
-    }{
-      Ops: tplOps,
-      Prices: hourlyVMPrices,
-      Project: project,
-    })
-    if err != nil {
-      fmt.Fprintln(w, err.Error())
-      return
-    }
+    return tplOps, pendingOps
 }
 
 type tplOp struct {
   Name string
-  Meta genomics.OperationMetadata
+  // API is the Pipelines API version which ran the operation.
+  API string
+  // Source is "live" or "imported".
+  Source string
+  Labels map[string]string
+  Request pipelineRequest
+  RawRequest []byte
+  RawRuntime []byte
+  Done bool
+  // Error is the operation's error message, if it failed.
+  Error string
   GCE *genomics.ComputeEngine
   Duration time.Duration
-  Hourly float64
+  Hourly money
+  PriceRegion string
+  FallbackPrice bool
+  // PriceVersion is the version of the price list the operation was priced with.
+  PriceVersion string
+  Hours float64
+  Cost money
+  CreateTime time.Time
+  StartTime time.Time
+  // QueueWait is the time between creation and start, or for a pending
+  // operation, the time it has been waiting so far.
+  QueueWait time.Duration
+  Pending bool
+  // Share is the fraction of the operation this is, once allocateOps
+  // has split it.
+  Share float64
+}
+
+func opError(op *genomics.Operation) string {
+  if op.Error == nil {
+    return ""
+  }
+  if op.Error.Message == "" {
+    return fmt.Sprintf("error code %d", op.Error.Code)
+  }
+  return op.Error.Message
+}
+
+// Status summarizes whether an operation is running, succeeded or failed.
+func (op tplOp) Status() string {
+  switch {
+  case op.Pending:
+    return "pending"
+  case !op.Done:
+    return "running"
+  case op.Error != "":
+    return "failed"
+  }
+  return "succeeded"
+}
+
+// LabelList returns the operation's labels as sorted key=value strings.
+func (op tplOp) LabelList() []string {
+  var labels []string
+  for k, v := range op.Labels {
+    labels = append(labels, k + "=" + v)
+  }
+  sort.Strings(labels)
+  return labels
+}
+
+// SharePercent formats Share as a percentage, e.g. "60%".
+func (op tplOp) SharePercent() string {
+  return fmt.Sprintf("%.4g%%", op.Share * 100)
+}
+
+// opTotals sums up a list of operations. Operations with an unknown
+// cost are counted instead of being added to Cost.
+type opTotals struct {
   Hours float64
-  Cost string
+  Cost money
+  Unknown int
+}
+
+func totalOps(ops []tplOp) opTotals {
+  t := opTotals{}
+  for _, op := range ops {
+    t.Hours += op.Hours
+    if op.Cost.Unknown() {
+      t.Unknown++
+      continue
+    }
+    t.Cost = t.Cost.Add(op.Cost)
+  }
+  return t
+}
+
+// PipelineName names the pipeline an operation ran, from its request or,
+// failing that, its "pipeline" label.
+func (op tplOp) PipelineName() string {
+  if op.Request.EphemeralPipeline.Name != "" {
+    return op.Request.EphemeralPipeline.Name
+  }
+  if name := op.Labels["pipeline"]; name != "" {
+    return name
+  }
+  return "(unnamed)"
+}
+
+// workflowLabels are the labels which workflow engines use to record which
+// workflow an operation belongs to, in order of preference.
+var workflowLabels = []string{"cromwell-workflow-id", "workflow-id", "workflow"}
+
+// Workflow names the workflow an operation was part of, or if it
+// wasn't run by a workflow engine, its pipeline.
+func (op tplOp) Workflow() string {
+  for _, l := range workflowLabels {
+    if v := op.Labels[l]; v != "" {
+      return v
+    }
+  }
+  return op.PipelineName()
 }
 
-var tpl = template.Must(template.New("page").Parse(`
-<h1>Google Pipelines Cost Dashboard for Project "{{.Project}}"</h1>
-
-<h2>Operations</h2>
-<table>
-<thead>
-  <th>Name</th>
-  <th>Duration</th>
-  <th>Machine Type</th>
-  <th>Hours Billed</th>
-  <th>Cost</th>
-</thead>
-<tbody>
-  {{ range $index, $el := .Ops }}
-  <tr>
-    <td>{{ $el.Name }}</td>
-    <td>{{ $el.Duration }}</td>
-    <td>{{ $el.GCE.MachineType }}</td>
-    <td>{{ $el.Hours }}</td>
-    <td>{{ $el.Cost }}</td>
-  </tr>
-  {{ end }}
-</tbody>
-</table>
-
-<h2>Prices</h2>
-
-<table>
-<thead>
-  <th>
-    machine
-  </th>
-  <th>
-    hourly price
-  </th>
-</thead>
-<tbody>
-  {{ range $index, $el := .Prices }}
-  <tr>
-    <td>{{ $index }}</td>
-    <td>{{ $el }}</td>
-  </tr>
-  {{ end }}
-</tbody>
-</table>
-`))
-
-
-var regions = strings.Fields(`
-us
-us-central1
-us-east1
-us-east4
-us-west1
-europe
-europe-west1
-europe-west2
-europe-west3
-asia
-asia-east
-asia-northeast
-asia-southeast
-australia
-australia-northeast
-australia-southeast
-`)
-
-var zones = strings.Fields("a b c d e f")
+var tpl = newPage("operations")
+
+
+// regionOf returns the region of a zone, e.g. "us-central1" for "us-central1-f".
+func regionOf(zone string) string {
+  i := strings.LastIndex(zone, "-")
+  if i == -1 {
+    return zone
+  }
+  return zone[:i]
+}
 
+// mixedPriceData is the current price list.
 var mixedPriceData struct {
   Version string
   Updated string
   PriceList map[string]interface{} `json:"gcp_price_list"`
 }
 
+// hourlyVMPrices maps "price-region/machine-type" to an hourly price,
+// in the current price list. Price regions are the keys used by the price
+// data, which are mostly regions, but also multi-regions like "us" and
+// older names like "asia-east".
 var hourlyVMPrices = map[string]float64{}
 
+// priceRegions is the set of price regions found in the current price list.
+var priceRegions = map[string]bool{}
+
+// sortedPriceRegions lists the price regions in order, for display.
+func sortedPriceRegions() []string {
+  var out []string
+  for r := range priceRegions {
+    out = append(out, r)
+  }
+  sort.Strings(out)
+  return out
+}
+
+// fallbackPriceRegions maps regions missing from the price data to a price
+// region to use instead, from the PRICE_REGION_FALLBACK environment
+// variable, e.g. "asia-northeast2=asia-northeast,*=us". The "*" entry
+// applies to any other missing region.
+var fallbackPriceRegions = map[string]string{}
+
+// vmPrice is the hourly price of a machine, and the price region and
+// price list version it came from.
+type vmPrice struct {
+  Hourly money
+  Region string
+  // Fallback is true when the machine's region isn't in the price data,
+  // so the price of another region was used.
+  Fallback bool
+  Version string
+}
+
+// vmPrice finds the hourly price of a machine type such as
+// "us-central1-f/n1-standard-1". Older regions appear in the price data
+// without their "1" suffix. Regions which don't appear at all are priced
+// using the configured fallback, or else the multi-region for their
+// continent, e.g. "asia" for "asia-northeast2".
+func (c *priceCatalog) vmPrice(machineType string) (vmPrice, bool) {
+  zone, vm := splitMachineType(machineType)
+  region := regionOf(zone)
+  if region == "" {
+    return vmPrice{}, false
+  }
+
+  for _, r := range []string{region, strings.TrimSuffix(region, "1")} {
+    if p, ok := c.VMPrices[r + "/" + vm]; ok {
+      return vmPrice{usd(p), r, false, c.Version}, true
+    }
+  }
+
+  fallback, ok := fallbackPriceRegions[region]
+  if !ok {
+    fallback, ok = fallbackPriceRegions["*"]
+  }
+  if !ok {
+    fallback = strings.SplitN(region, "-", 2)[0]
+  }
+  if p, ok := c.VMPrices[fallback + "/" + vm]; ok {
+    return vmPrice{usd(p), fallback, true, c.Version}, true
+  }
+  return vmPrice{}, false
+}
+
+// parsePairs reads a comma-separated list of key=value pairs, as found in
+// environment variables like PRICE_REGION_FALLBACK and BUCKET_LOCATIONS.
+func parsePairs(s string) (map[string]string, error) {
+  m := map[string]string{}
+  for _, f := range strings.Split(s, ",") {
+    f = strings.TrimSpace(f)
+    if f == "" {
+      continue
+    }
+    parts := strings.SplitN(f, "=", 2)
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+      return nil, fmt.Errorf("%q: expected key=value", f)
+    }
+    m[parts[0]] = parts[1]
+  }
+  return m, nil
+}
+
+// vmSpecFields are the fields of a VM image price entry which aren't regions.
+var vmSpecFields = map[string]bool{
+  "cores": true,
+  "memory": true,
+  "gceu": true,
+  "maxNumberOfPd": true,
+  "maxPdSize": true,
+  "ssd": true,
+}
+
+// vmSpec is the capacity of a machine type, from the "cores" and "memory"
+// fields of the price data. Shared-core machines have zero Cores.
+type vmSpec struct {
+  Cores float64
+  MemoryGB float64
+}
+
+var vmSpecs = map[string]vmSpec{}
+
 func init() {
-  err := json.Unmarshal([]byte(rawPriceData), &mixedPriceData)
+  var err error
+  priceCatalogs, err = loadPriceCatalogs([]byte(rawPriceData), os.Getenv("PRICE_CATALOGS"))
   if err != nil {
     panic(err)
   }
 
+  fallbackPriceRegions, err = parsePairs(os.Getenv("PRICE_REGION_FALLBACK"))
+  if err != nil {
+    panic(fmt.Errorf("PRICE_REGION_FALLBACK: %s", err))
+  }
 
-  for k, i := range mixedPriceData.PriceList {
-    if strings.HasPrefix(k, "CP-COMPUTEENGINE-VMIMAGE-") {
-      vm := strings.TrimPrefix(k, "CP-COMPUTEENGINE-VMIMAGE-")
-      vm = strings.ToLower(vm)
-      hourlyVMPrices[vm] = 0
+  current := currentCatalog()
+  mixedPriceData.Version = current.Version
+  mixedPriceData.Updated = current.Updated.Format("2-January-2006")
+  mixedPriceData.PriceList = current.PriceList
+  hourlyVMPrices = current.VMPrices
+  priceRegions = current.Regions
 
-      dat := i.(map[string]interface{})
-      for _, r := range regions {
-        if v, ok := dat[r]; ok {
-          price := v.(float64)
-          for _, z := range zones {
-            hourlyVMPrices[r + "-" + z + "/" + vm] = price
-          }
-        }
-      }
+  // Machine types which are no longer listed keep their specs.
+  for _, c := range priceCatalogs {
+    for vm, spec := range c.Specs {
+      vmSpecs[vm] = spec
     }
   }
 }
@@ -0,0 +1,134 @@
+package hello
+
+import (
+  "embed"
+  "html/template"
+  "net/http"
+  "sort"
+  "strings"
+)
+
+// navView is a view linked from the navigation bar. Role is the role
+// the view is registered with, so the link can be hidden from people
+// who can't see it.
+type navView struct {
+  Path string
+  Title string
+  Role role
+}
+
+var navViews = []navView{
+  {"/", "Operations", roleViewer},
+  {"/rightsizing", "Right-sizing", roleViewer},
+  {"/whatif", "What-if", roleViewer},
+  {"/cromwell", "Cromwell", roleViewer},
+  {"/unitcost", "Unit Costs", roleViewer},
+  {"/regressions", "Regressions", roleViewer},
+  {"/compare", "Compare", roleViewer},
+  {"/quota", "Quota Usage", roleViewer},
+  {"/egress", "Egress", roleFinance},
+  {"/storage", "Storage", roleFinance},
+  {"/reconcile", "Reconciliation", roleFinance},
+  {"/chargeback", "Chargeback", roleFinance},
+  {"/rules", "Allocation Rules", roleFinance},
+}
+
+// themes are the dashboard color schemes, the first being the default.
+var themes = []string{"light", "dark", "solarized"}
+
+// page is what every view's template is executed with. The view's own
+// data is in Data.
+type page struct {
+  Title string
+  Path string
+  Nav []navView
+  User authUser
+  Theme string
+  Themes []string
+  // Currency is what the view's amounts are in.
+  Currency string
+  Currencies []string
+  // Query is the view's query parameters, which switching the theme or
+  // currency keeps.
+  Query []queryParam
+  Data interface{}
+}
+
+type queryParam struct {
+  Name string
+  Value string
+}
+
+// templateFiles holds the layout and one template per view. Each view's
+// file defines a "content" template which the layout wraps.
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+// newPage parses a view's template, templates/<name>.html,
+// together with the shared layout.
+func newPage(name string) *template.Template {
+  return template.Must(template.New(name).ParseFS(templateFiles,
+    "templates/layout.html", "templates/" + name + ".html"))
+}
+
+// render writes a view inside the shared layout. The theme can be picked
+// with the "theme" query parameter, and is remembered in a cookie, as is
+// the currency picked with "currency".
+func render(w http.ResponseWriter, r *http.Request, t *template.Template, title string, data interface{}) error {
+  theme := themes[0]
+  if c, err := r.Cookie("theme"); err == nil && validTheme(c.Value) {
+    theme = c.Value
+  }
+  if q := r.URL.Query().Get("theme"); validTheme(q) {
+    theme = q
+    http.SetCookie(w, &http.Cookie{Name: "theme", Value: q, Path: "/", MaxAge: 365 * 24 * 60 * 60})
+  }
+  currency := requestCurrency(r)
+  if q := strings.ToUpper(r.URL.Query().Get("currency")); currencyConf.valid(q) {
+    http.SetCookie(w, &http.Cookie{Name: "currency", Value: q, Path: "/", MaxAge: 365 * 24 * 60 * 60})
+  }
+
+  var query []queryParam
+  for name, values := range r.URL.Query() {
+    if name == "theme" || name == "currency" {
+      continue
+    }
+    for _, v := range values {
+      query = append(query, queryParam{name, v})
+    }
+  }
+  sort.Slice(query, func(i, j int) bool {
+    return query[i].Name < query[j].Name
+  })
+
+  u, _ := currentUser(r)
+  var nav []navView
+  for _, v := range navViews {
+    if u.Role >= authConf.routeRole(v.Path, v.Role) {
+      nav = append(nav, v)
+    }
+  }
+
+  w.Header().Add("content-type", "text/html")
+  return t.ExecuteTemplate(w, "layout", page{
+    Title: title,
+    Path: r.URL.Path,
+    Nav: nav,
+    User: u,
+    Theme: theme,
+    Themes: themes,
+    Currency: currency,
+    Currencies: currencyConf.currencies(),
+    Query: query,
+    Data: data,
+  })
+}
+
+func validTheme(name string) bool {
+  for _, t := range themes {
+    if t == name {
+      return true
+    }
+  }
+  return false
+}
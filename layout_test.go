@@ -0,0 +1,116 @@
+package hello
+
+import (
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  genomics "google.golang.org/api/genomics/v1"
+)
+
+// hostile are values an operation's labels, pipeline name or error could
+// hold, meant to break out of the page's HTML.
+var hostile = []string{
+  `<script>alert(1)</script>`,
+  `"onmouseover=alert(1) x="`,
+  `javascript:alert(1)`,
+}
+
+func hostileOp(value string) tplOp {
+  op := tplOp{
+    Name: value,
+    Source: "live",
+    Labels: map[string]string{"lab": value, value: "x"},
+    Done: true,
+    Error: value,
+    GCE: &genomics.ComputeEngine{MachineType: "us-central1-f/n1-standard-1"},
+    Duration: time.Hour,
+    Hours: 1,
+    Hourly: usd(0.0475),
+    Cost: usd(0.0475),
+    StartTime: time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC),
+  }
+  op.Request.EphemeralPipeline.Name = value
+  return op
+}
+
+func TestTemplatesEscapeHostileValues(t *testing.T) {
+  pages := []struct {
+    name string
+    render func(w *httptest.ResponseRecorder, op tplOp) error
+  }{
+    {"operations", func(w *httptest.ResponseRecorder, op tplOp) error {
+      ops := []tplOp{op}
+      return render(w, httptest.NewRequest("GET", "/", nil), tpl, "Operations", struct {
+        Ops []tplOp
+        Totals opTotals
+        AtCurrentPrices bool
+        HistoricalTotals opTotals
+        CurrentTotals opTotals
+        CurrentVersion string
+        Pending []tplOp
+        QueueStats []queueStat
+        Forecast forecastResult
+        Alerts []alert
+        Prices map[string]float64
+        Project string
+      }{
+        Ops: ops,
+        Totals: totalOps(ops),
+        Pending: ops,
+        QueueStats: queueStats(ops),
+        Alerts: []alert{{Name: op.Name, Message: op.Error}},
+        Project: "p",
+      })
+    }},
+    {"operation", func(w *httptest.ResponseRecorder, op tplOp) error {
+      return render(w, httptest.NewRequest("GET", "/operation", nil), opDetailTpl, "Operation " + op.Name, struct {
+        Op tplOp
+        Request string
+        Metadata string
+      }{
+        Op: op,
+        Request: op.Error,
+        Metadata: op.Error,
+      })
+    }},
+    {"labels", func(w *httptest.ResponseRecorder, op tplOp) error {
+      rules, err := parseAllocationRules([]byte("allocations:\n- match: {lab: '*'}\n  split:\n  - {labels: {team: a}, percent: 50}\n  - {labels: {team: b}, percent: 50}\n"))
+      if err != nil {
+        return err
+      }
+      return render(w, httptest.NewRequest("GET", "/rules", nil), rulesTpl, "Allocation Rules", struct {
+        Project string
+        Rules string
+        Draft bool
+        Error string
+        Preview rulePreview
+      }{
+        Project: "p",
+        Rules: op.Error,
+        Preview: previewRules(rules, []tplOp{op}),
+      })
+    }},
+  }
+
+  for _, p := range pages {
+    for _, value := range hostile {
+      w := httptest.NewRecorder()
+      if err := p.render(w, hostileOp(value)); err != nil {
+        t.Errorf("%s page with %q: %s", p.name, value, err)
+        continue
+      }
+      body := w.Body.String()
+      for _, raw := range []string{`<script>alert(1)`, `"onmouseover=`, `href="javascript:`, `href="/operation?name=javascript:`} {
+        if strings.Contains(body, raw) {
+          t.Errorf("%s page with %q: found %q unescaped", p.name, value, raw)
+        }
+      }
+      // The values are there, escaped.
+      if !strings.Contains(body, "alert(1)") {
+        t.Errorf("%s page with %q: value not shown", p.name, value)
+      }
+    }
+  }
+}
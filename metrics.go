@@ -0,0 +1,314 @@
+package hello
+
+import (
+  "bytes"
+  "fmt"
+  "math"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/metrics", requireRole(roleViewer, metricsHandler))
+}
+
+// queueWaitBuckets are the upper bounds of the queue wait histogram.
+var queueWaitBuckets = []time.Duration{
+  30 * time.Second,
+  time.Minute,
+  5 * time.Minute,
+  15 * time.Minute,
+  30 * time.Minute,
+  time.Hour,
+  2 * time.Hour,
+  6 * time.Hour,
+}
+
+// metricsConfig limits how many series the exporter produces, since every
+// label value and machine type becomes a series. It's read from:
+//
+//   METRICS_MAX_SERIES  series per metric, 100 by default; the rest are
+//                       summed into a series whose labels are all "other"
+//   METRICS_LABEL_KEYS  comma-separated operation label keys to export cost
+//                       by, all of them by default
+type metricsConfig struct {
+  MaxSeries int
+  LabelKeys map[string]bool
+}
+
+func loadMetricsConfig() (metricsConfig, error) {
+  c := metricsConfig{MaxSeries: 100}
+  if s := os.Getenv("METRICS_MAX_SERIES"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 1 {
+      return c, fmt.Errorf("METRICS_MAX_SERIES: expected a positive number, got %q", s)
+    }
+    c.MaxSeries = n
+  }
+  if s := os.Getenv("METRICS_LABEL_KEYS"); s != "" {
+    c.LabelKeys = map[string]bool{}
+    for _, k := range strings.Split(s, ",") {
+      c.LabelKeys[strings.TrimSpace(k)] = true
+    }
+  }
+  return c, nil
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  conf, err := loadMetricsConfig()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  project, err := getProject(ctx)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  ops, pending, err := listOps(ctx, project)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  // Scrapers see the same series whoever's credentials they use, so costs
+  // are always in dollars, whatever currency the user sees pages in.
+  w.Header().Set("content-type", "text/plain; version=0.0.4")
+  w.Write(exportMetrics(project, convertOps(ops, "USD"), pending, conf))
+}
+
+// series is one sample of a metric, identified by its label values.
+type series struct {
+  Labels []string
+  Value float64
+}
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+  buf bytes.Buffer
+  conf metricsConfig
+}
+
+func (m *metricsWriter) header(name, typ, help string) {
+  fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m *metricsWriter) sample(name string, labelNames, labelValues []string, value float64) {
+  m.buf.WriteString(name)
+  if len(labelNames) != 0 {
+    m.buf.WriteString("{")
+    for i, l := range labelNames {
+      if i != 0 {
+        m.buf.WriteString(",")
+      }
+      fmt.Fprintf(&m.buf, "%s=\"%s\"", l, escapeLabelValue(labelValues[i]))
+    }
+    m.buf.WriteString("}")
+  }
+  m.buf.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+// metric writes a gauge or counter, keeping the largest series and summing
+// the rest into one "other" series if there are too many.
+func (m *metricsWriter) metric(name, typ, help string, labelNames []string, values map[string]*series) {
+  m.header(name, typ, help)
+  for _, s := range limitSeries(values, m.conf.MaxSeries, len(labelNames)) {
+    m.sample(name, labelNames, s.Labels, s.Value)
+  }
+}
+
+func limitSeries(values map[string]*series, max, labels int) []series {
+  var all []series
+  for _, s := range values {
+    all = append(all, *s)
+  }
+  sort.Slice(all, func(i, j int) bool {
+    if all[i].Value != all[j].Value {
+      return all[i].Value > all[j].Value
+    }
+    return strings.Join(all[i].Labels, ",") < strings.Join(all[j].Labels, ",")
+  })
+  if len(all) <= max {
+    return all
+  }
+
+  other := series{}
+  for i := 0; i < labels; i++ {
+    other.Labels = append(other.Labels, "other")
+  }
+  for _, s := range all[max - 1:] {
+    other.Value += s.Value
+  }
+  return append(all[:max - 1], other)
+}
+
+func addSeries(m map[string]*series, value float64, labels ...string) {
+  key := strings.Join(labels, "\x00")
+  s, ok := m[key]
+  if !ok {
+    s = &series{Labels: labels}
+    m[key] = s
+  }
+  s.Value += value
+}
+
+func escapeLabelValue(v string) string {
+  v = strings.Replace(v, `\`, `\\`, -1)
+  v = strings.Replace(v, `"`, `\"`, -1)
+  return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func formatMetricValue(v float64) string {
+  if math.IsInf(v, 1) {
+    return "+Inf"
+  }
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// exportMetrics derives Prometheus metrics from the dashboard's operations,
+// whose costs should be in US dollars.
+func exportMetrics(project string, ops, pending []tplOp, conf metricsConfig) []byte {
+  m := &metricsWriter{conf: conf}
+
+  running := map[string]*series{}
+  costs := map[string]*series{}
+  labelCosts := map[string]*series{}
+  statuses := map[string]*series{}
+  var unknown float64
+
+  for _, op := range ops {
+    zone, machine := splitMachineType(op.GCE.MachineType)
+    status := op.Status()
+    addSeries(statuses, 1, project, status)
+    if status == "running" {
+      addSeries(running, 1, machine, zone)
+    }
+
+    if op.Cost.Unknown() {
+      unknown++
+      continue
+    }
+    addSeries(costs, op.Cost.Float(), project)
+  }
+  for _, op := range allocateOps(ops) {
+    if op.Cost.Unknown() {
+      continue
+    }
+    for k, v := range op.Labels {
+      if conf.LabelKeys != nil && !conf.LabelKeys[k] {
+        continue
+      }
+      addSeries(labelCosts, op.Cost.Float(), project, k, v)
+    }
+  }
+
+  m.metric("pipelines_running_operations", "gauge",
+    "Operations currently running, by machine type and zone.",
+    []string{"machine_type", "zone"}, running)
+
+  m.header("pipelines_pending_operations", "gauge", "Operations waiting for a VM.")
+  m.sample("pipelines_pending_operations", []string{"project"}, []string{project}, float64(len(pending)))
+
+  m.metric("pipelines_operations", "gauge",
+    "Listed operations by status: running, succeeded or failed.",
+    []string{"project", "status"}, statuses)
+
+  failed := 0.0
+  if s, ok := statuses[project + "\x00failed"]; ok {
+    failed = s.Value
+  }
+  // Failures and costs are totals over the operations the API still lists,
+  // which drop off as they age, so they can go down and are gauges.
+  m.header("pipelines_failed_operations", "gauge", "Listed operations which failed.")
+  m.sample("pipelines_failed_operations", []string{"project"}, []string{project}, failed)
+
+  m.metric("pipelines_cost_dollars", "gauge",
+    "Estimated cost of listed operations.",
+    []string{"project"}, costs)
+
+  m.metric("pipelines_label_cost_dollars", "gauge",
+    "Estimated cost of listed operations, by operation label.",
+    []string{"project", "label", "value"}, labelCosts)
+
+  m.header("pipelines_unpriced_operations", "gauge", "Listed operations whose cost is unknown.")
+  m.sample("pipelines_unpriced_operations", []string{"project"}, []string{project}, unknown)
+
+  m.queueWaitHistogram(ops)
+  return m.buf.Bytes()
+}
+
+// queueWaitHistogram writes the queue wait of started operations as a
+// histogram per zone and machine type. Series beyond the limit are merged
+// into an "other" histogram.
+func (m *metricsWriter) queueWaitHistogram(ops []tplOp) {
+  const name = "pipelines_queue_wait_seconds"
+  type hist struct {
+    labels []string
+    counts []float64
+    sum float64
+    count float64
+  }
+  hists := map[string]*hist{}
+  for _, op := range ops {
+    if op.CreateTime.IsZero() {
+      continue
+    }
+    zone, machine := splitMachineType(op.GCE.MachineType)
+    key := machine + "\x00" + zone
+    h, ok := hists[key]
+    if !ok {
+      h = &hist{labels: []string{machine, zone}, counts: make([]float64, len(queueWaitBuckets))}
+      hists[key] = h
+    }
+    for i, b := range queueWaitBuckets {
+      if op.QueueWait <= b {
+        h.counts[i]++
+      }
+    }
+    h.sum += op.QueueWait.Seconds()
+    h.count++
+  }
+
+  var all []*hist
+  for _, h := range hists {
+    all = append(all, h)
+  }
+  sort.Slice(all, func(i, j int) bool {
+    if all[i].count != all[j].count {
+      return all[i].count > all[j].count
+    }
+    return strings.Join(all[i].labels, ",") < strings.Join(all[j].labels, ",")
+  })
+  if len(all) > m.conf.MaxSeries {
+    other := &hist{labels: []string{"other", "other"}, counts: make([]float64, len(queueWaitBuckets))}
+    for _, h := range all[m.conf.MaxSeries - 1:] {
+      for i := range h.counts {
+        other.counts[i] += h.counts[i]
+      }
+      other.sum += h.sum
+      other.count += h.count
+    }
+    all = append(all[:m.conf.MaxSeries - 1], other)
+  }
+
+  m.header(name, "histogram", "Time between an operation being created and starting.")
+  labelNames := []string{"machine_type", "zone", "le"}
+  for _, h := range all {
+    for i, b := range queueWaitBuckets {
+      m.sample(name + "_bucket", labelNames, append(h.labels, formatMetricValue(b.Seconds())), h.counts[i])
+    }
+    m.sample(name + "_bucket", labelNames, append(h.labels, "+Inf"), h.count)
+    m.sample(name + "_sum", labelNames[:2], h.labels, h.sum)
+    m.sample(name + "_count", labelNames[:2], h.labels, h.count)
+  }
+}
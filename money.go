@@ -0,0 +1,137 @@
+package hello
+
+import (
+  "fmt"
+  "math"
+)
+
+// money is an exact amount, in millionths of a unit of its currency.
+// Amounts which can't be worked out, such as the cost of a machine type
+// missing from the price list, are unknown rather than zero: they print
+// as "unknown" and make any sum they're part of unknown too, so callers
+// which want to skip them have to say so.
+type money struct {
+  micros int64
+  currency string
+  unknown bool
+}
+
+const microsPerUnit = 1000000
+
+var unknownMoney = money{unknown: true}
+
+// usd converts an amount of dollars, such as a price from the price list.
+func usd(amount float64) money {
+  return newMoney(amount, "USD")
+}
+
+// newMoney converts an amount, rounding to the nearest millionth,
+// with halves rounded away from zero.
+func newMoney(amount float64, currency string) money {
+  return money{micros: int64(math.Round(amount * microsPerUnit)), currency: currency}
+}
+
+func (m money) Unknown() bool {
+  return m.unknown
+}
+
+func (m money) Currency() string {
+  return m.currency
+}
+
+// Float returns the amount in units of its currency, for statistics and
+// charts which don't need to be exact. Unknown amounts are zero.
+func (m money) Float() float64 {
+  if m.unknown {
+    return 0
+  }
+  return float64(m.micros) / microsPerUnit
+}
+
+// Add adds two amounts. The zero value is a known zero in any currency,
+// so sums can start from it; adding amounts in two different currencies
+// gives an unknown amount.
+func (m money) Add(o money) money {
+  if m.unknown || o.unknown {
+    return unknownMoney
+  }
+  currency := m.currency
+  if currency == "" {
+    currency = o.currency
+  } else if o.currency != "" && o.currency != currency {
+    return unknownMoney
+  }
+  return money{micros: m.micros + o.micros, currency: currency}
+}
+
+func (m money) Sub(o money) money {
+  return m.Add(o.Neg())
+}
+
+func (m money) Neg() money {
+  m.micros = -m.micros
+  return m
+}
+
+func (m money) Abs() money {
+  if m.micros < 0 {
+    return m.Neg()
+  }
+  return m
+}
+
+// Mul multiplies an amount, e.g. an hourly price by a number of hours,
+// rounding the same way as newMoney.
+func (m money) Mul(x float64) money {
+  if m.unknown {
+    return m
+  }
+  m.micros = int64(math.Round(float64(m.micros) * x))
+  return m
+}
+
+// Cmp compares two amounts without regard to currency. Unknown amounts
+// come before all known ones.
+func (m money) Cmp(o money) int {
+  switch {
+  case m.unknown && o.unknown:
+    return 0
+  case m.unknown:
+    return -1
+  case o.unknown:
+    return 1
+  case m.micros < o.micros:
+    return -1
+  case m.micros > o.micros:
+    return 1
+  }
+  return 0
+}
+
+// exchange converts an amount to another currency, given how many units
+// of that currency one unit of this one buys. It rounds the same way as
+// newMoney.
+func (m money) exchange(currency string, rate float64) money {
+  if m.unknown {
+    return m
+  }
+  return money{micros: int64(math.Round(float64(m.micros) * rate)), currency: currency}
+}
+
+func (m money) IsZero() bool {
+  return !m.unknown && m.micros == 0
+}
+
+// String formats the amount with six decimal places, or as "unknown".
+func (m money) String() string {
+  if m.unknown {
+    return "unknown"
+  }
+  sign := ""
+  micros := m.micros
+  if micros < 0 {
+    sign = "-"
+    micros = -micros
+  }
+  return fmt.Sprintf("%s%d.%06d", sign, micros / microsPerUnit, micros % microsPerUnit)
+}
@@ -0,0 +1,77 @@
+package hello
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestMoneyRounding(t *testing.T) {
+  for _, c := range []struct {
+    name string
+    m money
+    want string
+  }{
+    {"price", usd(0.0475), "0.047500"},
+    {"below a micro", usd(0.0000004), "0.000000"},
+    {"half a micro", usd(0.0000005), "0.000001"},
+    {"negative half a micro", usd(-0.0000005), "-0.000001"},
+    {"negative", usd(-1.25), "-1.250000"},
+    {"hours", usd(0.0475).Mul(1.0 / 3), "0.015833"},
+    {"half up", money{micros: 1}.Mul(0.5), "0.000001"},
+    {"half down", money{micros: -1}.Mul(0.5), "-0.000001"},
+    {"sum", usd(0.1).Add(usd(0.2)), "0.300000"},
+    {"difference", usd(0.1).Sub(usd(0.3)), "-0.200000"},
+    {"unknown", unknownMoney.Mul(2), "unknown"},
+    {"unknown sum", usd(1).Add(unknownMoney), "unknown"},
+    {"mixed currencies", usd(1).Add(newMoney(1, "EUR")), "unknown"},
+  } {
+    if got := c.m.String(); got != c.want {
+      t.Errorf("%s: %s, want %s", c.name, got, c.want)
+    }
+  }
+
+  // A sum starting from the zero value takes the currency of what's added.
+  if m := (money{}).Add(newMoney(2, "EUR")); m.Currency() != "EUR" || m.String() != "2.000000" {
+    t.Errorf("zero plus 2 EUR = %s %s", m, m.Currency())
+  }
+}
+
+func TestExchangeRates(t *testing.T) {
+  rates := exchangeRates{}
+  if err := readExchangeRates(strings.NewReader("date,currency,rate\n2018-01-01,EUR,0.8\n2018-03-01,EUR,0.9\n2018-01-01,gbp,0.75\n"), rates); err != nil {
+    t.Fatal(err)
+  }
+  jan := time.Date(2017, 12, 15, 0, 0, 0, 0, time.UTC)
+  feb := time.Date(2018, 2, 15, 0, 0, 0, 0, time.UTC)
+  mar := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+  for _, c := range []struct {
+    name string
+    m money
+    currency string
+    at time.Time
+    want string
+  }{
+    {"before the first rate", usd(10), "EUR", jan, "8.000000"},
+    {"first rate", usd(10), "EUR", feb, "8.000000"},
+    {"from the day of the second rate", usd(10), "EUR", mar, "9.000000"},
+    {"back to USD", newMoney(9, "EUR"), "USD", mar, "10.000000"},
+    {"between currencies", newMoney(8, "EUR"), "GBP", feb, "7.500000"},
+    {"rounded", usd(0.0000015), "EUR", mar, "0.000002"},
+    {"same currency", newMoney(1, "EUR"), "EUR", mar, "1.000000"},
+    {"no rate", usd(1), "JPY", mar, "unknown"},
+    {"unknown", unknownMoney, "EUR", mar, "unknown"},
+  } {
+    got := rates.convert(c.m, c.currency, c.at)
+    if got.String() != c.want {
+      t.Errorf("%s: %s, want %s", c.name, got, c.want)
+    }
+    if !got.Unknown() && got.Currency() != c.currency {
+      t.Errorf("%s: in %s, want %s", c.name, got.Currency(), c.currency)
+    }
+  }
+
+  if err := readExchangeRates(strings.NewReader("2018-01-01,EUR,0\n"), exchangeRates{}); err == nil {
+    t.Error("expected an error for a zero rate")
+  }
+}
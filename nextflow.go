@@ -0,0 +1,269 @@
+package hello
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// loadImportedRuns reads the Nextflow trace files in IMPORTED_RUNS, a
+// comma-separated list of paths or globs, e.g. "/data/runs/*/trace.txt".
+// Files ending in .json are read as JSON, anything else as trace.txt.
+// Tasks whose trace doesn't say which zone they ran in are priced as
+// if they ran in defaultZone, from IMPORTED_ZONE.
+func loadImportedRuns(patterns, defaultZone string) ([]opRecord, error) {
+  var recs []opRecord
+  for _, pattern := range strings.Split(patterns, ",") {
+    pattern = strings.TrimSpace(pattern)
+    if pattern == "" {
+      continue
+    }
+    paths, err := filepath.Glob(pattern)
+    if err != nil {
+      return nil, err
+    }
+    for _, p := range paths {
+      r, err := loadNextflowTrace(p, defaultZone)
+      if err != nil {
+        return nil, fmt.Errorf("imported run %s: %s", p, err)
+      }
+      recs = append(recs, r...)
+    }
+  }
+  return recs, nil
+}
+
+func loadNextflowTrace(path, defaultZone string) ([]opRecord, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  var rows []map[string]string
+  if strings.HasSuffix(path, ".json") {
+    rows, err = readNextflowJSON(f)
+  } else {
+    rows, err = readNextflowTSV(f)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  run := filepath.Base(filepath.Dir(path))
+  var recs []opRecord
+  for _, row := range rows {
+    // Cached tasks reuse an earlier result, so nothing ran.
+    if row["status"] == "CACHED" {
+      continue
+    }
+    recs = append(recs, nextflowRecord(run, row, defaultZone))
+  }
+  return recs, nil
+}
+
+// readNextflowTSV reads trace.txt, a tab-separated file with a header line.
+// Missing values, written as "-", are left out.
+func readNextflowTSV(r io.Reader) ([]map[string]string, error) {
+  scanner := bufio.NewScanner(r)
+  var header []string
+  var rows []map[string]string
+  for scanner.Scan() {
+    fields := strings.Split(scanner.Text(), "\t")
+    if header == nil {
+      header = fields
+      continue
+    }
+    row := map[string]string{}
+    for i, f := range fields {
+      f = strings.TrimSpace(f)
+      if i < len(header) && f != "-" {
+        row[header[i]] = f
+      }
+    }
+    rows = append(rows, row)
+  }
+  return rows, scanner.Err()
+}
+
+// readNextflowJSON reads trace records with the same fields as trace.txt,
+// either as an array or, as in the data of an execution report, under "trace".
+func readNextflowJSON(r io.Reader) ([]map[string]string, error) {
+  b, err := ioutil.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+  // Numbers are kept as written, since raw timestamps don't fit in a float.
+  decode := func(v interface{}) error {
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    return dec.Decode(v)
+  }
+
+  var objs []map[string]interface{}
+  if strings.HasPrefix(strings.TrimSpace(string(b)), "{") {
+    var report struct {
+      Trace []map[string]interface{} `json:"trace"`
+    }
+    err = decode(&report)
+    objs = report.Trace
+  } else {
+    err = decode(&objs)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var rows []map[string]string
+  for _, o := range objs {
+    row := map[string]string{}
+    for k, v := range o {
+      if v != nil {
+        row[k] = fmt.Sprint(v)
+      }
+    }
+    rows = append(rows, row)
+  }
+  return rows, nil
+}
+
+// nextflowRecord turns a trace record into an operation. Traces only say
+// which machine a task ran on when run with a cloud executor; otherwise
+// it's taken to be the cheapest one which fits the requested resources.
+func nextflowRecord(run string, row map[string]string, defaultZone string) opRecord {
+  name := strings.Replace(row["hash"], "/", "", -1)
+  if name == "" {
+    name = run + "-" + row["task_id"]
+  }
+
+  rec := opRecord{
+    Name: "imported/" + name,
+    API: "nextflow",
+    Source: sourceImported,
+    Done: true,
+    Labels: map[string]string{"nextflow-run": run},
+  }
+  if p := row["process"]; p != "" {
+    rec.Labels["pipeline"] = p
+  }
+  if t := row["tag"]; t != "" {
+    rec.Labels["tag"] = t
+  }
+  switch row["status"] {
+  case "FAILED", "ABORTED":
+    rec.Error = strings.ToLower(row["status"])
+    if exit := row["exit"]; exit != "" {
+      rec.Error += " with exit code " + exit
+    }
+  }
+
+  rec.CreateTime = parseNextflowTime(row["submit"])
+  rec.StartTime = parseNextflowTime(row["start"])
+  rec.EndTime = parseNextflowTime(row["complete"])
+  // Older traces only have the submit time and how long the task took.
+  if rec.StartTime.IsZero() {
+    rec.StartTime = rec.CreateTime
+  }
+  if rec.EndTime.IsZero() && !rec.StartTime.IsZero() {
+    d := parseNextflowDuration(row["realtime"])
+    if d == 0 {
+      d = parseNextflowDuration(row["duration"])
+    }
+    rec.EndTime = rec.StartTime.Add(d)
+  }
+
+  req := pipelineRequest{}
+  req.EphemeralPipeline.Name = row["process"]
+  res := &req.EphemeralPipeline.Resources
+  res.MinimumCpuCores, _ = strconv.ParseFloat(row["cpus"], 64)
+  res.MinimumRamGb = float64(parseNextflowBytes(row["memory"])) / bytesPerGB
+  res.Preemptible = row["price_model"] == "spot" || row["price_model"] == "preemptible"
+  rec.Request = req
+
+  zone := row["cloud_zone"]
+  if zone == "" {
+    zone = defaultZone
+  }
+  machine := row["machine_type"]
+  if machine == "" {
+    machine, _ = catalogAt(rec.StartTime).cheapestFit(zone, res.MinimumCpuCores, res.MinimumRamGb, res.Preemptible)
+  }
+  rec.GCE.Zone = zone
+  rec.GCE.MachineType = zone + "/" + preemptibleMachine(machine, res.Preemptible)
+  rec.GCE.InstanceName = row["native_id"]
+
+  rec.RawRequest, _ = json.Marshal(row)
+  return rec
+}
+
+// parseNextflowTime reads a trace timestamp, which is either
+// "2006-01-02 15:04:05.000" in the time zone the run was in, taken
+// to be UTC, or with "-raw", milliseconds since the epoch.
+func parseNextflowTime(s string) time.Time {
+  if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+    return time.Unix(0, ms * int64(time.Millisecond)).UTC()
+  }
+  t, err := time.Parse("2006-01-02 15:04:05.000", s)
+  if err != nil {
+    t, _ = time.Parse("2006-01-02 15:04:05", s)
+  }
+  return t
+}
+
+var nextflowDurationPart = regexp.MustCompile(`([0-9.]+)\s*(ms|d|h|m|s)`)
+
+// parseNextflowDuration reads a trace duration such as "1h 2m 3s" or
+// "150ms", or with "-raw", a number of milliseconds.
+func parseNextflowDuration(s string) time.Duration {
+  if ms, err := strconv.ParseFloat(s, 64); err == nil {
+    return time.Duration(ms * float64(time.Millisecond))
+  }
+  units := map[string]time.Duration{
+    "ms": time.Millisecond,
+    "s": time.Second,
+    "m": time.Minute,
+    "h": time.Hour,
+    "d": 24 * time.Hour,
+  }
+  var d time.Duration
+  for _, m := range nextflowDurationPart.FindAllStringSubmatch(s, -1) {
+    n, _ := strconv.ParseFloat(m[1], 64)
+    d += time.Duration(n * float64(units[m[2]]))
+  }
+  return d
+}
+
+// parseNextflowBytes reads a trace memory size such as "8 GB",
+// or with "-raw", a number of bytes.
+func parseNextflowBytes(s string) int64 {
+  fields := strings.Fields(s)
+  if len(fields) == 0 {
+    return 0
+  }
+  n, err := strconv.ParseFloat(fields[0], 64)
+  if err != nil {
+    return 0
+  }
+  if len(fields) == 2 {
+    switch strings.ToUpper(fields[1]) {
+    case "KB":
+      n *= 1 << 10
+    case "MB":
+      n *= 1 << 20
+    case "GB":
+      n *= 1 << 30
+    case "TB":
+      n *= 1 << 40
+    }
+  }
+  return int64(n)
+}
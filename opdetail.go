@@ -0,0 +1,70 @@
+package hello
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "net/http"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/operation", requireRole(roleAdmin, opDetailHandler))
+}
+
+// opDetailHandler shows the raw metadata and pipeline request of one
+// operation. Requests include the commands pipelines run and their inputs,
+// so this is restricted to admins by default.
+func opDetailHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, pending, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  name := r.URL.Query().Get("name")
+  var found *tplOp
+  for _, op := range append(ops, pending...) {
+    if op.Name == name {
+      found = &op
+      break
+    }
+  }
+  if found == nil {
+    http.NotFound(w, r)
+    return
+  }
+
+  err = render(w, r, opDetailTpl, "Operation " + name, struct {
+    Op tplOp
+    Request string
+    Metadata string
+  }{
+    Op: *found,
+    Request: indentJSON(found.RawRequest),
+    Metadata: indentJSON(found.RawRuntime),
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+func indentJSON(raw []byte) string {
+  var buf bytes.Buffer
+  if err := json.Indent(&buf, raw, "", "  "); err != nil {
+    return string(raw)
+  }
+  return buf.String()
+}
+
+var opDetailTpl = newPage("operation")
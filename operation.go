@@ -0,0 +1,308 @@
+package hello
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/url"
+  "os"
+  "strings"
+  "time"
+
+  "golang.org/x/oauth2/google"
+  "google.golang.org/api/genomics/v1"
+)
+
+// Operation metadata types, one per Pipelines API version.
+const (
+  metadataV1 = "type.googleapis.com/google.genomics.v1.OperationMetadata"
+  metadataV2Alpha1 = "type.googleapis.com/google.genomics.v2alpha1.Metadata"
+  metadataV2Beta = "type.googleapis.com/google.cloud.lifesciences.v2beta.Metadata"
+)
+
+// Sources of operations. Imported operations come from files, such as the
+// run records collaborators send us, rather than from a service.
+const (
+  sourceLive = "live"
+  sourceImported = "imported"
+)
+
+// opRecord is what the dashboard needs to know about an operation,
+// whichever API version ran it.
+type opRecord struct {
+  Name string
+  // API is the version which ran the operation: "v1alpha2", "v2alpha1" or
+  // "v2beta", or for other sources, their format, e.g. "tes/v1".
+  API string
+  Source string
+  Done bool
+  Error string
+  Labels map[string]string
+  CreateTime time.Time
+  // StartTime is zero until the operation has been given a VM.
+  StartTime time.Time
+  EndTime time.Time
+  GCE genomics.ComputeEngine
+  Request pipelineRequest
+  // RawRequest and RawRuntime are the operation's pipeline and what it
+  // reported about the VM it ran on, as the API returned them.
+  RawRequest []byte
+  RawRuntime []byte
+}
+
+// decodeOperation picks a decoder by the operation's metadata type.
+// Operations without one are assumed to come from the v1 API.
+func decodeOperation(op *genomics.Operation) (opRecord, error) {
+  var typ struct {
+    Type string `json:"@type"`
+  }
+  if err := json.Unmarshal(op.Metadata, &typ); err != nil {
+    return opRecord{}, fmt.Errorf("operation %s: %s", op.Name, err)
+  }
+
+  var rec opRecord
+  var err error
+  switch typ.Type {
+  case metadataV1, "":
+    rec, err = decodeV1(op.Metadata)
+  case metadataV2Alpha1:
+    rec, err = decodeV2(op.Metadata, "v2alpha1")
+  case metadataV2Beta:
+    rec, err = decodeV2(op.Metadata, "v2beta")
+  default:
+    err = fmt.Errorf("unsupported metadata type %s", typ.Type)
+  }
+  if err != nil {
+    return rec, fmt.Errorf("operation %s: %s", op.Name, err)
+  }
+
+  rec.Name = op.Name
+  rec.Source = sourceLive
+  rec.Done = op.Done
+  rec.Error = opError(op)
+  return rec, nil
+}
+
+// decodeV1 decodes the metadata of Pipelines v1alpha2 operations,
+// which are listed through the Genomics v1 API.
+func decodeV1(raw []byte) (opRecord, error) {
+  meta := genomics.OperationMetadata{}
+  if err := json.Unmarshal(raw, &meta); err != nil {
+    return opRecord{}, err
+  }
+
+  rec := opRecord{
+    API: "v1alpha2",
+    Labels: meta.Labels,
+    Request: parseRequest(meta.Request),
+    RawRequest: meta.Request,
+    RawRuntime: meta.RuntimeMetadata,
+  }
+  rec.CreateTime, _ = time.Parse(time.RFC3339, meta.CreateTime)
+  rec.StartTime, _ = time.Parse(time.RFC3339, meta.StartTime)
+  rec.EndTime, _ = time.Parse(time.RFC3339, meta.EndTime)
+
+  runtime := genomics.RuntimeMetadata{}
+  json.Unmarshal(meta.RuntimeMetadata, &runtime)
+  if runtime.ComputeEngine != nil {
+    rec.GCE = *runtime.ComputeEngine
+  }
+  // The machine type reported doesn't say whether the VM was preemptible,
+  // only the pipeline's resources do.
+  zone, machine := splitMachineType(rec.GCE.MachineType)
+  machine = preemptibleMachine(machine, rec.Request.resources().Preemptible)
+  if zone != "" {
+    machine = zone + "/" + machine
+  }
+  rec.GCE.MachineType = machine
+  return rec, nil
+}
+
+// v2Metadata is the subset of v2alpha1 and Life Sciences v2beta operation
+// metadata which the dashboard cares about. The two only differ in parts
+// the dashboard doesn't look at.
+type v2Metadata struct {
+  Pipeline struct {
+    Actions []struct {
+      ImageURI string `json:"imageUri"`
+      Commands []string `json:"commands"`
+    } `json:"actions"`
+    Resources struct {
+      Zones []string `json:"zones"`
+      VirtualMachine struct {
+        MachineType string `json:"machineType"`
+        Preemptible bool `json:"preemptible"`
+      } `json:"virtualMachine"`
+    } `json:"resources"`
+  } `json:"pipeline"`
+  Labels map[string]string `json:"labels"`
+  Events []v2Event `json:"events"`
+  CreateTime string `json:"createTime"`
+  StartTime string `json:"startTime"`
+  EndTime string `json:"endTime"`
+}
+
+type v2Event struct {
+  Timestamp string `json:"timestamp"`
+  Description string `json:"description"`
+  Details struct {
+    Type string `json:"@type"`
+    // Set on WorkerAssignedEvent. v2alpha1 doesn't report the machine type.
+    Zone string `json:"zone"`
+    Instance string `json:"instance"`
+    MachineType string `json:"machineType"`
+  } `json:"details"`
+}
+
+// decodeV2 decodes the metadata of v2alpha1 and Life Sciences v2beta
+// operations. The VM is described by the pipeline's resources and by the
+// workerAssigned event, and the pipeline is a list of container actions
+// instead of a single Docker command.
+func decodeV2(raw []byte, api string) (opRecord, error) {
+  meta := v2Metadata{}
+  if err := json.Unmarshal(raw, &meta); err != nil {
+    return opRecord{}, err
+  }
+
+  rec := opRecord{
+    API: api,
+    Labels: meta.Labels,
+  }
+  rec.CreateTime, _ = time.Parse(time.RFC3339, meta.CreateTime)
+  rec.StartTime, _ = time.Parse(time.RFC3339, meta.StartTime)
+  rec.EndTime, _ = time.Parse(time.RFC3339, meta.EndTime)
+
+  vm := meta.Pipeline.Resources.VirtualMachine
+  machine := vm.MachineType
+  zone := ""
+  for _, e := range meta.Events {
+    if !strings.HasSuffix(e.Details.Type, ".WorkerAssignedEvent") {
+      continue
+    }
+    zone = e.Details.Zone
+    rec.GCE.InstanceName = e.Details.Instance
+    if e.Details.MachineType != "" {
+      machine = e.Details.MachineType
+    }
+    // Older operations have no start time, but are started
+    // as soon as they're given a worker.
+    if rec.StartTime.IsZero() {
+      rec.StartTime, _ = time.Parse(time.RFC3339, e.Timestamp)
+    }
+  }
+  if !rec.StartTime.IsZero() {
+    rec.GCE.Zone = zone
+    rec.GCE.MachineType = zone + "/" + preemptibleMachine(machine, vm.Preemptible)
+  }
+
+  // v2 pipelines ask for a machine type rather than a minimum number of
+  // cores and memory, so that's what they're taken to need.
+  req := pipelineRequest{}
+  res := &req.EphemeralPipeline.Resources
+  if spec, ok := vmSpecs[machine]; ok {
+    res.MinimumCpuCores = spec.Cores
+    res.MinimumRamGb = spec.MemoryGB
+  }
+  res.Preemptible = vm.Preemptible
+  res.Zones = meta.Pipeline.Resources.Zones
+
+  // The main action is taken to be the first one which isn't just copying
+  // files with the Cloud SDK, as workflow engines do around the real work.
+  actions := meta.Pipeline.Actions
+  for i, a := range actions {
+    if !isCloudSDKImage(a.ImageURI) || i == len(actions) - 1 {
+      req.EphemeralPipeline.Docker.ImageName = a.ImageURI
+      req.EphemeralPipeline.Docker.Cmd = strings.Join(a.Commands, " ")
+      break
+    }
+  }
+  rec.Request = req
+
+  var pipeline struct {
+    Pipeline json.RawMessage `json:"pipeline"`
+    Events json.RawMessage `json:"events"`
+  }
+  json.Unmarshal(raw, &pipeline)
+  rec.RawRequest = pipeline.Pipeline
+  rec.RawRuntime = pipeline.Events
+  return rec, nil
+}
+
+// preemptibleMachine returns the name preemptible VMs of a machine type
+// are priced under, e.g. "n1-standard-1-preemptible".
+func preemptibleMachine(machine string, preemptible bool) string {
+  if !preemptible || machine == "" || strings.HasSuffix(machine, "-preemptible") {
+    return machine
+  }
+  return machine + "-preemptible"
+}
+
+func isCloudSDKImage(image string) bool {
+  return strings.Contains(image, "google/cloud-sdk") || strings.Contains(image, "cloudsdktool")
+}
+
+// shortOpName shortens a Google operation name, which depending on the
+// API looks like "operations/ID", "projects/P/operations/ID" or
+// "projects/P/locations/L/operations/ID", to the start of its ID. Other
+// names, like TES task IDs, whose starts aren't unique, are kept whole.
+func shortOpName(name string) string {
+  i := strings.LastIndex(name, "operations/")
+  if i == -1 {
+    return name
+  }
+  id := name[i + len("operations/"):]
+  if len(id) > 10 {
+    id = id[:10]
+  }
+  return id
+}
+
+// listLifeSciencesOps lists the project's operations in each of the
+// comma-separated Life Sciences locations in LIFESCIENCES_LOCATIONS, e.g.
+// "us-central1,europe-west2". Those aren't visible to the Genomics API.
+func listLifeSciencesOps(ctx context.Context, project string) ([]*genomics.Operation, error) {
+  locations := os.Getenv("LIFESCIENCES_LOCATIONS")
+  if locations == "" {
+    return nil, nil
+  }
+
+  client, err := google.DefaultClient(ctx, genomics.CloudPlatformScope)
+  if err != nil {
+    return nil, err
+  }
+
+  var ops []*genomics.Operation
+  for _, loc := range strings.Split(locations, ",") {
+    loc = strings.TrimSpace(loc)
+    u := "https://lifesciences.googleapis.com/v2beta/projects/" + url.PathEscape(project) +
+      "/locations/" + url.PathEscape(loc) + "/operations"
+
+    for token := ""; ; {
+      pageURL := u
+      if token != "" {
+        pageURL += "?pageToken=" + url.QueryEscape(token)
+      }
+      resp, err := client.Get(pageURL)
+      if err != nil {
+        return nil, err
+      }
+      var page genomics.ListOperationsResponse
+      if resp.StatusCode != http.StatusOK {
+        err = fmt.Errorf("life sciences API %s: %s", loc, resp.Status)
+      } else {
+        err = json.NewDecoder(resp.Body).Decode(&page)
+      }
+      resp.Body.Close()
+      if err != nil {
+        return nil, err
+      }
+      ops = append(ops, page.Operations...)
+      token = page.NextPageToken
+      if token == "" {
+        break
+      }
+    }
+  }
+  return ops, nil
+}
@@ -0,0 +1,154 @@
+package hello
+
+import (
+  "encoding/json"
+  "testing"
+  "time"
+
+  genomics "google.golang.org/api/genomics/v1"
+)
+
+// decoderFixtures are one finished operation of each Pipelines API
+// version, as the operations list returns them, trimmed to what's decoded.
+var decoderFixtures = []struct {
+  api string
+  json string
+  machineType string
+  preemptible bool
+  image string
+  instance string
+}{
+  {"v1alpha2", `{
+    "name": "operations/ENCr4PyCLBiT3aCx8pCCxgEg0qmFxLIKKg9wcm9kdWN0aW9uUXVldWU",
+    "done": true,
+    "metadata": {
+      "@type": "type.googleapis.com/google.genomics.v1.OperationMetadata",
+      "createTime": "2018-03-01T10:00:00Z",
+      "startTime": "2018-03-01T10:02:00Z",
+      "endTime": "2018-03-01T11:02:00Z",
+      "labels": {"sample": "NA12878"},
+      "request": {
+        "ephemeralPipeline": {
+          "name": "align",
+          "resources": {"minimumCpuCores": 1, "minimumRamGb": 3.75, "preemptible": true},
+          "docker": {"imageName": "gcr.io/p/bwa:0.7.17", "cmd": "bwa mem"}
+        },
+        "pipelineArgs": {"resources": {"zones": ["us-central1-f"]}}
+      },
+      "runtimeMetadata": {
+        "computeEngine": {
+          "instanceName": "ggp-123",
+          "zone": "us-central1-f",
+          "machineType": "us-central1-f/n1-standard-1"
+        }
+      }
+    }
+  }`, "us-central1-f/n1-standard-1-preemptible", true, "gcr.io/p/bwa:0.7.17", "ggp-123"},
+
+  {"v2alpha1", `{
+    "name": "projects/p/operations/123",
+    "done": true,
+    "metadata": {
+      "@type": "type.googleapis.com/google.genomics.v2alpha1.Metadata",
+      "createTime": "2018-03-01T10:00:00Z",
+      "endTime": "2018-03-01T11:02:00Z",
+      "labels": {"sample": "NA12878"},
+      "pipeline": {
+        "actions": [
+          {"imageUri": "google/cloud-sdk:slim", "commands": ["gsutil", "cp"]},
+          {"imageUri": "gcr.io/p/bwa:0.7.17", "commands": ["bwa", "mem"]}
+        ],
+        "resources": {
+          "zones": ["us-central1-f"],
+          "virtualMachine": {"machineType": "n1-standard-1", "preemptible": true}
+        }
+      },
+      "events": [{
+        "timestamp": "2018-03-01T10:02:00Z",
+        "description": "Worker \"google-pipelines-worker-1\" assigned in \"us-central1-f\"",
+        "details": {
+          "@type": "type.googleapis.com/google.genomics.v2alpha1.WorkerAssignedEvent",
+          "zone": "us-central1-f",
+          "instance": "google-pipelines-worker-1"
+        }
+      }]
+    }
+  }`, "us-central1-f/n1-standard-1-preemptible", true, "gcr.io/p/bwa:0.7.17", "google-pipelines-worker-1"},
+
+  {"v2beta", `{
+    "name": "projects/p/locations/us-central1/operations/456",
+    "done": true,
+    "metadata": {
+      "@type": "type.googleapis.com/google.cloud.lifesciences.v2beta.Metadata",
+      "createTime": "2018-03-01T10:00:00Z",
+      "startTime": "2018-03-01T10:02:00Z",
+      "endTime": "2018-03-01T11:02:00Z",
+      "labels": {"sample": "NA12878"},
+      "pipeline": {
+        "actions": [{"imageUri": "gcr.io/p/bwa:0.7.17", "commands": ["bwa", "mem"]}],
+        "resources": {
+          "zones": ["us-central1-f"],
+          "virtualMachine": {"machineType": "n1-standard-2", "preemptible": false}
+        }
+      },
+      "events": [{
+        "timestamp": "2018-03-01T10:02:00Z",
+        "description": "Worker \"google-pipelines-worker-2\" assigned in \"us-central1-f\" on a \"n1-standard-1\" machine",
+        "details": {
+          "@type": "type.googleapis.com/google.cloud.lifesciences.v2beta.WorkerAssignedEvent",
+          "zone": "us-central1-f",
+          "instance": "google-pipelines-worker-2",
+          "machineType": "n1-standard-1"
+        }
+      }]
+    }
+  }`, "us-central1-f/n1-standard-1", false, "gcr.io/p/bwa:0.7.17", "google-pipelines-worker-2"},
+}
+
+func TestDecodeOperation(t *testing.T) {
+  start := time.Date(2018, 3, 1, 10, 2, 0, 0, time.UTC)
+  for _, f := range decoderFixtures {
+    op := &genomics.Operation{}
+    if err := json.Unmarshal([]byte(f.json), op); err != nil {
+      t.Fatalf("%s: %s", f.api, err)
+    }
+    rec, err := decodeOperation(op)
+    if err != nil {
+      t.Errorf("%s: %s", f.api, err)
+      continue
+    }
+    if rec.API != f.api || rec.Name != op.Name || !rec.Done || rec.Source != sourceLive {
+      t.Errorf("%s: decoded as %s %q, done %v, source %q", f.api, rec.API, rec.Name, rec.Done, rec.Source)
+    }
+    if !rec.StartTime.Equal(start) || rec.EndTime.Sub(rec.StartTime) != time.Hour || rec.CreateTime.IsZero() {
+      t.Errorf("%s: times %s, %s, %s", f.api, rec.CreateTime, rec.StartTime, rec.EndTime)
+    }
+    if rec.GCE.MachineType != f.machineType || rec.GCE.InstanceName != f.instance {
+      t.Errorf("%s: VM %q, %q; want %q, %q", f.api, rec.GCE.MachineType, rec.GCE.InstanceName, f.machineType, f.instance)
+    }
+    res := rec.Request.resources()
+    if res.Preemptible != f.preemptible || rec.Request.EphemeralPipeline.Docker.ImageName != f.image {
+      t.Errorf("%s: preemptible %v, image %q", f.api, res.Preemptible, rec.Request.EphemeralPipeline.Docker.ImageName)
+    }
+    if rec.Labels["sample"] != "NA12878" {
+      t.Errorf("%s: labels %v", f.api, rec.Labels)
+    }
+
+    // Preemptible VMs are priced as such, whichever API ran them.
+    ops, _ := priceOps([]opRecord{rec}, start.Add(2 * time.Hour))
+    want, ok := catalogAt(start).vmPrice(f.machineType)
+    if len(ops) != 1 || !ok {
+      t.Errorf("%s: %d priced operations, price found %v", f.api, len(ops), ok)
+    } else if ops[0].Hourly.Cmp(want.Hourly) != 0 {
+      t.Errorf("%s: priced at %s an hour, want %s", f.api, ops[0].Hourly, want.Hourly)
+    }
+  }
+}
+
+func TestDecodeUnknownMetadata(t *testing.T) {
+  op := &genomics.Operation{}
+  json.Unmarshal([]byte(`{"name": "operations/x", "metadata": {"@type": "type.googleapis.com/google.genomics.v3.Metadata"}}`), op)
+  if _, err := decodeOperation(op); err == nil {
+    t.Error("unknown metadata type decoded")
+  }
+}
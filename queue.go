@@ -0,0 +1,93 @@
+package hello
+
+import (
+  "math"
+  "sort"
+  "strings"
+  "time"
+)
+
+// queueStat describes how long operations waited between being created
+// and getting a VM, for one zone and machine type.
+type queueStat struct {
+  Zone string
+  MachineType string
+  Count int
+  P50 time.Duration
+  P95 time.Duration
+  Max time.Duration
+}
+
+// queueStats groups started operations by zone and machine type and
+// computes the distribution of their queue wait times.
+func queueStats(ops []tplOp) []queueStat {
+  type key struct {
+    zone, machine string
+  }
+  waits := map[key][]time.Duration{}
+
+  for _, op := range ops {
+    if op.Pending || op.CreateTime.IsZero() || op.StartTime.IsZero() {
+      continue
+    }
+    zone, machine := splitMachineType(op.GCE.MachineType)
+    if op.GCE.Zone != "" {
+      zone = op.GCE.Zone
+    }
+    k := key{zone, machine}
+    waits[k] = append(waits[k], op.QueueWait)
+  }
+
+  var stats []queueStat
+  for k, ds := range waits {
+    sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+    stats = append(stats, queueStat{
+      Zone: k.zone,
+      MachineType: k.machine,
+      Count: len(ds),
+      P50: percentile(ds, 50),
+      P95: percentile(ds, 95),
+      Max: ds[len(ds)-1],
+    })
+  }
+
+  sort.Slice(stats, func(i, j int) bool {
+    if stats[i].Zone != stats[j].Zone {
+      return stats[i].Zone < stats[j].Zone
+    }
+    return stats[i].MachineType < stats[j].MachineType
+  })
+  return stats
+}
+
+// percentile returns the p-th percentile of sorted durations,
+// using the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+  if len(sorted) == 0 {
+    return 0
+  }
+  return sorted[percentileIndex(len(sorted), p)]
+}
+
+// percentileIndex returns the index of the p-th percentile of n sorted
+// values, using the nearest-rank method. n must be positive.
+func percentileIndex(n int, p float64) int {
+  rank := int(math.Ceil(p / 100 * float64(n)))
+  if rank < 1 {
+    rank = 1
+  }
+  if rank > n {
+    rank = n
+  }
+  return rank-1
+}
+
+// splitMachineType splits a machine type such as "us-central1-f/n1-standard-1"
+// into its zone and machine parts.
+func splitMachineType(mt string) (zone, machine string) {
+  i := strings.LastIndex(mt, "/")
+  if i == -1 {
+    return "", mt
+  }
+  return mt[:i], mt[i+1:]
+}
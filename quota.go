@@ -0,0 +1,340 @@
+package hello
+
+import (
+  "fmt"
+  "math"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/quota", requireRole(roleViewer, quotaHandler))
+}
+
+// quotaMetrics are what's counted of the VMs running in a region.
+var quotaMetrics = []string{"vms", "cpus", "preemptible_cpus", "memory"}
+
+// quotaLimit is the quota of one metric in a region.
+type quotaLimit struct {
+  Region string
+  Metric string
+  Limit float64
+}
+
+// parseQuotas reads quotas from a comma-separated list of region/metric=limit
+// entries, e.g. "us-central1/cpus=24,us-central1/vms=10", as found in the
+// QUOTAS environment variable. Metrics are vms, cpus, preemptible_cpus and
+// memory, in GB. A region of "*" sets the quota of regions without one of
+// their own.
+func parseQuotas(s string) ([]quotaLimit, error) {
+  pairs, err := parsePairs(s)
+  if err != nil {
+    return nil, err
+  }
+  var quotas []quotaLimit
+  for k, v := range pairs {
+    parts := strings.SplitN(k, "/", 2)
+    if len(parts) != 2 || parts[0] == "" {
+      return nil, fmt.Errorf("quota %q: expected region/metric=limit", k)
+    }
+    known := false
+    for _, m := range quotaMetrics {
+      known = known || m == parts[1]
+    }
+    if !known {
+      return nil, fmt.Errorf("quota %q: metric must be one of %s", k, strings.Join(quotaMetrics, ", "))
+    }
+    limit, err := strconv.ParseFloat(v, 64)
+    if err != nil || limit <= 0 {
+      return nil, fmt.Errorf("quota %q: bad limit %q", k, v)
+    }
+    quotas = append(quotas, quotaLimit{parts[0], parts[1], limit})
+  }
+  return quotas, nil
+}
+
+// quotaFor returns a region's quota of a metric, if it has one.
+func quotaFor(quotas []quotaLimit, region, metric string) (float64, bool) {
+  limit, ok := 0.0, false
+  for _, q := range quotas {
+    if q.Metric != metric {
+      continue
+    }
+    if q.Region == region {
+      return q.Limit, true
+    }
+    if q.Region == "*" {
+      limit, ok = q.Limit, true
+    }
+  }
+  return limit, ok
+}
+
+// usageStep is what was running in a region from a time until the next step.
+type usageStep struct {
+  Time time.Time
+  Values map[string]float64
+}
+
+// metricUsage is the usage of one metric in a region, drawn as a graph.
+type metricUsage struct {
+  Metric string
+  Peak float64
+  PeakTime time.Time
+  Quota float64
+  HasQuota bool
+  // Saturated is how long usage was at or over the quota.
+  Saturated time.Duration
+  // Points is an SVG polyline of the usage, and QuotaY the height of the
+  // quota line, both in a quotaGraphWidth by quotaGraphHeight box.
+  Points string
+  QuotaY float64
+  Max float64
+}
+
+type regionUsage struct {
+  Region string
+  Metrics []metricUsage
+  // Unsized counts operations whose machine type's cores and memory
+  // aren't known, and which are left out.
+  Unsized int
+}
+
+type quotaReport struct {
+  From time.Time
+  To time.Time
+  Regions []regionUsage
+}
+
+func (r quotaReport) FromDate() string {
+  return r.From.Format("2006-01-02")
+}
+
+// ToDate is the last day of the range, for the "to" input, which is
+// inclusive. To is either midnight after that day or the current time.
+func (r quotaReport) ToDate() string {
+  return r.To.Add(-time.Nanosecond).Format("2006-01-02")
+}
+
+const (
+  quotaGraphWidth = 800
+  quotaGraphHeight = 150
+)
+
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  quotas, err := parseQuotas(os.Getenv("QUOTAS"))
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  // The graphs cover the last week by default. Operations count while
+  // they ran within the range, even if they started before it.
+  filter := parseOpFilter(r)
+  now := time.Now().UTC()
+  from, to := filter.From, filter.To
+  if to.IsZero() || to.After(now) {
+    to = now
+  }
+  if from.IsZero() {
+    from = to.AddDate(0, 0, -7)
+  }
+  filter.From, filter.To = time.Time{}, time.Time{}
+
+  report := quotaUsage(filterOps(ops, filter), quotas, from, to)
+
+  err = render(w, r, quotaTpl, "Quota Usage", struct {
+    Project string
+    Filter opFilter
+    Quotas []quotaLimit
+    Report quotaReport
+  }{
+    Project: project,
+    Filter: filter,
+    Quotas: quotas,
+    Report: report,
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// quotaUsage works out how many VMs, vCPUs and GB of memory were running
+// in each region between two times, from when operations started and how
+// long they ran. Machine types are sized from the price list, and custom
+// ones from the resources the operation asked for. Like Compute Engine,
+// preemptible vCPUs count towards preemptible_cpus in regions with a quota
+// of them, and towards cpus in the others.
+func quotaUsage(ops []tplOp, quotas []quotaLimit, from, to time.Time) quotaReport {
+  report := quotaReport{From: from, To: to}
+
+  type event struct {
+    at time.Time
+    sign float64
+    spec vmSpec
+    preemptible bool
+  }
+  events := map[string][]event{}
+  unsized := map[string]int{}
+  for _, op := range ops {
+    zone, machine := splitMachineType(op.GCE.MachineType)
+    if op.GCE.Zone != "" {
+      zone = op.GCE.Zone
+    }
+    if zone == "" {
+      continue
+    }
+    region := regionOf(zone)
+    start, end := op.StartTime, op.StartTime.Add(op.Duration)
+    if !end.After(from) || !start.Before(to) {
+      continue
+    }
+    if start.Before(from) {
+      start = from
+    }
+    if end.After(to) {
+      end = to
+    }
+    res := op.Request.resources()
+    spec, ok := vmSpecs[machine]
+    if !ok {
+      spec = vmSpec{res.MinimumCpuCores, res.MinimumRamGb}
+    }
+    preemptible := strings.HasSuffix(machine, "-preemptible") || res.Preemptible
+    if spec.Cores == 0 {
+      unsized[region]++
+      if _, ok := events[region]; !ok {
+        events[region] = nil
+      }
+      continue
+    }
+    events[region] = append(events[region], event{start, 1, spec, preemptible}, event{end, -1, spec, preemptible})
+  }
+
+  for region, evs := range events {
+    // Ends sort before starts at the same time, so a VM replacing
+    // another doesn't count twice.
+    sort.Slice(evs, func(i, j int) bool {
+      if !evs[i].at.Equal(evs[j].at) {
+        return evs[i].at.Before(evs[j].at)
+      }
+      return evs[i].sign < evs[j].sign
+    })
+
+    _, separate := quotaFor(quotas, region, "preemptible_cpus")
+    steps := []usageStep{{from, map[string]float64{}}}
+    cur := map[string]float64{}
+    for i, ev := range evs {
+      cur["vms"] += ev.sign
+      if ev.preemptible && separate {
+        cur["preemptible_cpus"] += ev.sign * ev.spec.Cores
+      } else {
+        cur["cpus"] += ev.sign * ev.spec.Cores
+      }
+      cur["memory"] += ev.sign * ev.spec.MemoryGB
+      if i + 1 < len(evs) && evs[i + 1].at.Equal(ev.at) {
+        continue
+      }
+      values := map[string]float64{}
+      for k, v := range cur {
+        values[k] = v
+      }
+      if ev.at.Equal(from) {
+        steps[0].Values = values
+      } else {
+        steps = append(steps, usageStep{ev.at, values})
+      }
+    }
+
+    ru := regionUsage{Region: region, Unsized: unsized[region]}
+    for _, m := range quotaMetrics {
+      ru.Metrics = append(ru.Metrics, graphUsage(steps, m, quotas, region, from, to))
+    }
+    report.Regions = append(report.Regions, ru)
+  }
+  sort.Slice(report.Regions, func(i, j int) bool {
+    return report.Regions[i].Region < report.Regions[j].Region
+  })
+  return report
+}
+
+// graphUsage finds the peak of a metric and how long it was at its quota,
+// and draws it as steps.
+func graphUsage(steps []usageStep, metric string, quotas []quotaLimit, region string, from, to time.Time) metricUsage {
+  mu := metricUsage{Metric: metric}
+  mu.Quota, mu.HasQuota = quotaFor(quotas, region, metric)
+
+  for i, s := range steps {
+    v := s.Values[metric]
+    if v > mu.Peak {
+      mu.Peak, mu.PeakTime = v, s.Time
+    }
+    end := to
+    if i + 1 < len(steps) {
+      end = steps[i + 1].Time
+    }
+    if mu.HasQuota && v >= mu.Quota {
+      mu.Saturated += end.Sub(s.Time)
+    }
+  }
+
+  mu.Max = math.Max(mu.Peak, mu.Quota) * 1.1
+  if mu.Max == 0 {
+    mu.Max = 1
+  }
+  span := to.Sub(from).Seconds()
+  x := func(t time.Time) float64 {
+    if span <= 0 {
+      return 0
+    }
+    return t.Sub(from).Seconds() / span * quotaGraphWidth
+  }
+  y := func(v float64) float64 {
+    return quotaGraphHeight - v / mu.Max * quotaGraphHeight
+  }
+
+  var points []string
+  for i, s := range steps {
+    v := s.Values[metric]
+    if i > 0 {
+      points = append(points, fmt.Sprintf("%.1f,%.1f", x(s.Time), y(steps[i - 1].Values[metric])))
+    }
+    points = append(points, fmt.Sprintf("%.1f,%.1f", x(s.Time), y(v)))
+  }
+  points = append(points, fmt.Sprintf("%.1f,%.1f", x(to), y(steps[len(steps) - 1].Values[metric])))
+  mu.Points = strings.Join(points, " ")
+  mu.QuotaY = math.Round(y(mu.Quota) * 10) / 10
+  return mu
+}
+
+// SaturatedShare is the fraction of the time usage was at its quota.
+func (r quotaReport) SaturatedShare(d time.Duration) string {
+  span := r.To.Sub(r.From)
+  if span <= 0 {
+    return ""
+  }
+  return fmt.Sprintf("%.1f%%", float64(d) / float64(span) * 100)
+}
+
+var quotaTpl = newPage("quota")
@@ -0,0 +1,317 @@
+package hello
+
+import (
+  "fmt"
+  "math"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/regressions", requireRole(roleViewer, regressionsHandler))
+}
+
+// regressionConfig says when a new image version counts as a regression.
+// It's read from:
+//
+//   REGRESSION_ALPHA      the p-value below which a change is significant, 0.01 by default
+//   REGRESSION_MIN_RATIO  how many times the previous version's median cost or
+//                         duration the new one's must be, 1.2 by default
+//   REGRESSION_MIN_RUNS   successful runs each version needs to be compared, 5 by default
+type regressionConfig struct {
+  Alpha float64
+  MinRatio float64
+  MinRuns int
+}
+
+func loadRegressionConfig() (regressionConfig, error) {
+  c := regressionConfig{Alpha: 0.01, MinRatio: 1.2, MinRuns: 5}
+  if s := os.Getenv("REGRESSION_ALPHA"); s != "" {
+    v, err := strconv.ParseFloat(s, 64)
+    if err != nil || v <= 0 || v >= 1 {
+      return c, fmt.Errorf("REGRESSION_ALPHA: expected a number between 0 and 1, got %q", s)
+    }
+    c.Alpha = v
+  }
+  if s := os.Getenv("REGRESSION_MIN_RATIO"); s != "" {
+    v, err := strconv.ParseFloat(s, 64)
+    if err != nil || v < 1 {
+      return c, fmt.Errorf("REGRESSION_MIN_RATIO: expected a number of at least 1, got %q", s)
+    }
+    c.MinRatio = v
+  }
+  if s := os.Getenv("REGRESSION_MIN_RUNS"); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 2 {
+      return c, fmt.Errorf("REGRESSION_MIN_RUNS: expected a number of at least 2, got %q", s)
+    }
+    c.MinRuns = n
+  }
+  return c, nil
+}
+
+// parseImage splits a docker image name into the image and its version,
+// which is the digest if there is one, or else the tag.
+func parseImage(name string) (image, version string) {
+  if i := strings.Index(name, "@"); i != -1 {
+    return name[:i], name[i + 1:]
+  }
+  if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+    return name[:i], name[i + 1:]
+  }
+  return name, "latest"
+}
+
+// imageVersion is the successful runs of a pipeline with one version
+// of an image.
+type imageVersion struct {
+  Version string
+  First time.Time
+  Costs []float64
+  Durations []float64
+}
+
+// regression compares the runs of a pipeline with an image version to
+// its runs with the version used before. Costs and durations are medians
+// per run, and the p-values are those of a one-sided Mann-Whitney U test
+// of the new version's runs costing, or taking, more.
+type regression struct {
+  Pipeline string
+  Image string
+  From string
+  To string
+  Since time.Time
+  FromRuns int
+  ToRuns int
+  FromCost money
+  ToCost money
+  CostRatio float64
+  CostP float64
+  FromDuration time.Duration
+  ToDuration time.Duration
+  DurationRatio float64
+  DurationP float64
+  CostRegressed bool
+  DurationRegressed bool
+}
+
+func (r regression) Flagged() bool {
+  return r.CostRegressed || r.DurationRegressed
+}
+
+func regressionsHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  conf, err := loadRegressionConfig()
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  err = render(w, r, regressionsTpl, "Regressions", struct {
+    Project string
+    Config regressionConfig
+    Regressions []regression
+  }{
+    Project: project,
+    Config: conf,
+    Regressions: findRegressions(ops, conf),
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// findRegressions groups successful operations by pipeline, image and
+// image version, and compares each version with the one before it, in the
+// order they were first used. Costs are compared in USD, as priced, so
+// changes in exchange rates can't look like regressions. Versions with
+// too few runs are left out of the comparison.
+func findRegressions(ops []tplOp, conf regressionConfig) []regression {
+  type key struct {
+    pipeline, image string
+  }
+  groups := map[key]map[string]*imageVersion{}
+  for _, op := range ops {
+    name := op.Request.EphemeralPipeline.Docker.ImageName
+    if op.Status() != "succeeded" || name == "" {
+      continue
+    }
+    image, version := parseImage(name)
+    k := key{op.PipelineName(), image}
+    if groups[k] == nil {
+      groups[k] = map[string]*imageVersion{}
+    }
+    v, ok := groups[k][version]
+    if !ok {
+      v = &imageVersion{Version: version, First: op.StartTime}
+      groups[k][version] = v
+    }
+    if op.StartTime.Before(v.First) {
+      v.First = op.StartTime
+    }
+    v.Durations = append(v.Durations, op.Duration.Seconds())
+    if !op.Cost.Unknown() {
+      v.Costs = append(v.Costs, op.Cost.Float())
+    }
+  }
+
+  var regs []regression
+  for k, versions := range groups {
+    var ordered []*imageVersion
+    for _, v := range versions {
+      if len(v.Durations) >= conf.MinRuns {
+        ordered = append(ordered, v)
+      }
+    }
+    sort.Slice(ordered, func(i, j int) bool {
+      return ordered[i].First.Before(ordered[j].First)
+    })
+
+    for i := 1; i < len(ordered); i++ {
+      from, to := ordered[i - 1], ordered[i]
+      r := regression{
+        Pipeline: k.pipeline,
+        Image: k.image,
+        From: from.Version,
+        To: to.Version,
+        Since: to.First,
+        FromRuns: len(from.Durations),
+        ToRuns: len(to.Durations),
+        FromDuration: time.Duration(median(from.Durations) * float64(time.Second)),
+        ToDuration: time.Duration(median(to.Durations) * float64(time.Second)),
+        DurationRatio: ratio(median(to.Durations), median(from.Durations)),
+        DurationP: mannWhitney(from.Durations, to.Durations),
+        FromCost: unknownMoney,
+        ToCost: unknownMoney,
+        CostP: 1,
+      }
+      r.DurationRegressed = r.DurationP < conf.Alpha && r.DurationRatio >= conf.MinRatio
+      if len(from.Costs) >= conf.MinRuns && len(to.Costs) >= conf.MinRuns {
+        r.FromCost = usd(median(from.Costs))
+        r.ToCost = usd(median(to.Costs))
+        r.CostRatio = ratio(median(to.Costs), median(from.Costs))
+        r.CostP = mannWhitney(from.Costs, to.Costs)
+        r.CostRegressed = r.CostP < conf.Alpha && r.CostRatio >= conf.MinRatio
+      }
+      regs = append(regs, r)
+    }
+  }
+
+  sort.Slice(regs, func(i, j int) bool {
+    a, b := regs[i], regs[j]
+    if a.Flagged() != b.Flagged() {
+      return a.Flagged()
+    }
+    if a.Pipeline != b.Pipeline {
+      return a.Pipeline < b.Pipeline
+    }
+    return a.Since.Before(b.Since)
+  })
+  return regs
+}
+
+func median(values []float64) float64 {
+  if len(values) == 0 {
+    return 0
+  }
+  sorted := append([]float64(nil), values...)
+  sort.Float64s(sorted)
+  n := len(sorted)
+  if n % 2 == 1 {
+    return sorted[n / 2]
+  }
+  return (sorted[n / 2 - 1] + sorted[n / 2]) / 2
+}
+
+// ratio returns a / b, or 1 if both are zero.
+func ratio(a, b float64) float64 {
+  if b == 0 {
+    if a == 0 {
+      return 1
+    }
+    return math.Inf(1)
+  }
+  return a / b
+}
+
+// mannWhitney returns the p-value of a one-sided Mann-Whitney U test of
+// values in b tending to be greater than those in a. It uses the normal
+// approximation with a continuity correction and a correction for ties,
+// which is good enough with five or more values in each.
+func mannWhitney(a, b []float64) float64 {
+  n1, n2 := float64(len(a)), float64(len(b))
+  if n1 == 0 || n2 == 0 {
+    return 1
+  }
+  u, ties := mannWhitneyU(a, b)
+  n := n1 + n2
+  mean := n1 * n2 / 2
+  sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties / (n * (n - 1))))
+  if sigma == 0 {
+    return 1
+  }
+  z := (u - mean - 0.5) / sigma
+  return 0.5 * math.Erfc(z / math.Sqrt2)
+}
+
+// mannWhitneyU returns the U statistic of b, the number of pairs of a
+// value from each where b's is greater, with ties counting a half, and
+// the sum of t³-t over each group of t tied values.
+func mannWhitneyU(a, b []float64) (u, ties float64) {
+  type value struct {
+    v float64
+    inB bool
+  }
+  var all []value
+  for _, v := range a {
+    all = append(all, value{v, false})
+  }
+  for _, v := range b {
+    all = append(all, value{v, true})
+  }
+  sort.Slice(all, func(i, j int) bool {
+    return all[i].v < all[j].v
+  })
+
+  // Tied values share the average of their ranks.
+  rankSumB := 0.0
+  for i := 0; i < len(all); {
+    j := i
+    for j < len(all) && all[j].v == all[i].v {
+      j++
+    }
+    rank := float64(i + j + 1) / 2
+    for k := i; k < j; k++ {
+      if all[k].inB {
+        rankSumB += rank
+      }
+    }
+    t := float64(j - i)
+    ties += t * t * t - t
+    i = j
+  }
+  n2 := float64(len(b))
+  return rankSumB - n2 * (n2 + 1) / 2, ties
+}
+
+var regressionsTpl = newPage("regressions")
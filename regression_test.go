@@ -0,0 +1,54 @@
+package hello
+
+import (
+  "math"
+  "testing"
+)
+
+func TestMannWhitney(t *testing.T) {
+  // The p-values are scipy.stats.mannwhitneyu(b, a, alternative="greater",
+  // method="asymptotic"), and U is the number of pairs where b's value
+  // is greater, ties counting a half.
+  for _, c := range []struct {
+    a, b []float64
+    u, ties, p float64
+  }{
+    {[]float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10}, 25, 0, 0.006092890177672},
+    {[]float64{6, 7, 8, 9, 10}, []float64{1, 2, 3, 4, 5}, 0, 0, 0.996692324517236},
+    {[]float64{1, 2, 3, 4, 5}, []float64{1, 2, 3, 4, 5}, 12.5, 30, 0.542235013311614},
+    {[]float64{10, 12, 12, 15, 17, 20}, []float64{14, 15, 18, 18, 21, 25, 30}, 34.5, 18, 0.031101668337388},
+    {[]float64{1.2, 3.4, 2.2, 5.1, 4.0}, []float64{3.0, 6.1, 5.5, 7.2, 4.8}, 21, 0, 0.047346471299738},
+  } {
+    u, ties := mannWhitneyU(c.a, c.b)
+    if u != c.u || ties != c.ties {
+      t.Errorf("mannWhitneyU(%v, %v) = %v, %v; want %v, %v", c.a, c.b, u, ties, c.u, c.ties)
+    }
+    if p := mannWhitney(c.a, c.b); math.Abs(p - c.p) > 1e-9 {
+      t.Errorf("mannWhitney(%v, %v) = %v, want %v", c.a, c.b, p, c.p)
+    }
+  }
+
+  for _, c := range [][2][]float64{{nil, {1, 2}}, {{1, 2}, nil}, {{3}, {3}}} {
+    if p := mannWhitney(c[0], c[1]); p != 1 {
+      t.Errorf("mannWhitney(%v, %v) = %v, want 1", c[0], c[1], p)
+    }
+  }
+}
+
+func TestParseImage(t *testing.T) {
+  for _, c := range []struct {
+    name, image, version string
+  }{
+    {"gcr.io/p/bwa:0.7.17", "gcr.io/p/bwa", "0.7.17"},
+    {"gcr.io/p/bwa@sha256:abc", "gcr.io/p/bwa", "sha256:abc"},
+    {"gcr.io/p/bwa:1@sha256:abc", "gcr.io/p/bwa:1", "sha256:abc"},
+    {"localhost:5000/bwa", "localhost:5000/bwa", "latest"},
+    {"localhost:5000/bwa:2", "localhost:5000/bwa", "2"},
+    {"ubuntu", "ubuntu", "latest"},
+  } {
+    image, version := parseImage(c.name)
+    if image != c.image || version != c.version {
+      t.Errorf("parseImage(%q) = %q, %q; want %q, %q", c.name, image, version, c.image, c.version)
+    }
+  }
+}
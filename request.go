@@ -0,0 +1,61 @@
+package hello
+
+import (
+  "encoding/json"
+)
+
+// pipelineRequest is the subset of a Pipelines v1alpha2 RunPipelineRequest
+// (found in OperationMetadata.Request) which the dashboard cares about.
+type pipelineRequest struct {
+  EphemeralPipeline struct {
+    Name string `json:"name"`
+    Resources pipelineResources `json:"resources"`
+    Docker struct {
+      ImageName string `json:"imageName"`
+      Cmd string `json:"cmd"`
+    } `json:"docker"`
+  } `json:"ephemeralPipeline"`
+  PipelineArgs struct {
+    Resources pipelineResources `json:"resources"`
+    Inputs map[string]string `json:"inputs"`
+    Outputs map[string]string `json:"outputs"`
+    Labels map[string]string `json:"labels"`
+  } `json:"pipelineArgs"`
+}
+
+type pipelineResources struct {
+  MinimumCpuCores float64 `json:"minimumCpuCores"`
+  MinimumRamGb float64 `json:"minimumRamGb"`
+  Preemptible bool `json:"preemptible"`
+  Zones []string `json:"zones"`
+}
+
+// parseRequest decodes the pipeline request stored in operation metadata.
+// Requests that can't be decoded are returned empty.
+func parseRequest(raw []byte) pipelineRequest {
+  req := pipelineRequest{}
+  if len(raw) != 0 {
+    json.Unmarshal(raw, &req)
+  }
+  return req
+}
+
+// resources returns the requested resources, with the run-time
+// pipeline arguments taking precedence over the pipeline definition.
+func (p pipelineRequest) resources() pipelineResources {
+  res := p.EphemeralPipeline.Resources
+  args := p.PipelineArgs.Resources
+  if args.MinimumCpuCores != 0 {
+    res.MinimumCpuCores = args.MinimumCpuCores
+  }
+  if args.MinimumRamGb != 0 {
+    res.MinimumRamGb = args.MinimumRamGb
+  }
+  if args.Preemptible {
+    res.Preemptible = true
+  }
+  if len(args.Zones) != 0 {
+    res.Zones = args.Zones
+  }
+  return res
+}
@@ -0,0 +1,293 @@
+package hello
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/rightsizing", requireRole(roleViewer, rightsizeHandler))
+}
+
+// rightsizeHeadroom is added on top of measured peak usage
+// before looking for a smaller machine.
+const rightsizeHeadroom = 1.2
+
+// instanceUsage is the peak utilisation of a VM, as a fraction of its capacity.
+type instanceUsage struct {
+  PeakCPU float64
+  PeakMemory float64
+}
+
+// rightsizeRow is a recommendation for all operations of one pipeline
+// which ran on the same machine type.
+type rightsizeRow struct {
+  Pipeline string
+  MachineType string
+  Ops int
+  Hours float64
+  Cost money
+  NeedCores float64
+  NeedMemoryGB float64
+  // Measured is true when the need comes from imported usage metrics
+  // rather than from the resources in the pipeline request.
+  Measured bool
+  Suggested string
+  SuggestedCost money
+  Savings money
+}
+
+func rightsizeHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  usage := map[string]instanceUsage{}
+  if path := os.Getenv("USAGE_EXPORT"); path != "" {
+    usage, err = loadUsageExport(path)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
+      return
+    }
+  }
+
+  rows := rightsize(ops, usage, requestCurrency(r))
+  totals := rightsizeRow{}
+  for _, row := range rows {
+    totals.Ops += row.Ops
+    totals.Hours += row.Hours
+    totals.Cost = totals.Cost.Add(row.Cost)
+    totals.Savings = totals.Savings.Add(row.Savings)
+  }
+
+  err = render(w, r, rightsizeTpl, "Right-sizing", struct {
+    Project string
+    Rows []rightsizeRow
+    Totals rightsizeRow
+    HaveUsage bool
+  }{
+    Project: project,
+    Rows: rows,
+    Totals: totals,
+    HaveUsage: len(usage) != 0,
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// rightsize groups operations by pipeline and machine type, works out the
+// capacity each group actually needs, and suggests the cheapest machine type
+// which provides it. Costs are converted to currency.
+func rightsize(ops []tplOp, usage map[string]instanceUsage, currency string) []rightsizeRow {
+  ops = convertOps(ops, currency)
+  type key struct {
+    pipeline, machine string
+  }
+  groups := map[key]*rightsizeRow{}
+  members := map[key][]tplOp{}
+
+  for _, op := range ops {
+    if op.Cost.Unknown() {
+      continue
+    }
+    zone, machine := splitMachineType(op.GCE.MachineType)
+    spec, ok := vmSpecs[machine]
+    if !ok || zone == "" {
+      continue
+    }
+
+    res := op.Request.resources()
+    cores := res.MinimumCpuCores
+    mem := res.MinimumRamGb
+    measured := false
+    // Usage metrics replace the requested resources where we have them.
+    // Memory is only reported when the monitoring agent is installed, and
+    // an export may hold only one of the two series for an instance.
+    if u, ok := usage[op.GCE.InstanceName]; ok {
+      if u.PeakCPU != 0 {
+        cores = spec.Cores * u.PeakCPU * rightsizeHeadroom
+        measured = true
+      }
+      if u.PeakMemory != 0 {
+        mem = spec.MemoryGB * u.PeakMemory * rightsizeHeadroom
+        measured = true
+      }
+    }
+
+    k := key{op.PipelineName(), machine}
+    row, ok := groups[k]
+    if !ok {
+      row = &rightsizeRow{Pipeline: k.pipeline, MachineType: machine, Measured: true}
+      groups[k] = row
+    }
+    row.Ops++
+    row.Hours += op.Hours
+    row.Cost = row.Cost.Add(op.Cost)
+    row.Measured = row.Measured && measured
+    if cores > row.NeedCores {
+      row.NeedCores = cores
+    }
+    if mem > row.NeedMemoryGB {
+      row.NeedMemoryGB = mem
+    }
+    members[k] = append(members[k], op)
+  }
+
+  var rows []rightsizeRow
+  for k, row := range groups {
+    ops := members[k]
+    zone, _ := splitMachineType(ops[0].GCE.MachineType)
+    preemptible := strings.HasSuffix(k.machine, "-preemptible")
+
+    // The suggestion is the cheapest fit at the prices of when the
+    // group's latest operation ran, and each operation is repriced at
+    // the prices of when it started, like its estimate.
+    latest := ops[0].StartTime
+    for _, op := range ops {
+      if op.StartTime.After(latest) {
+        latest = op.StartTime
+      }
+    }
+    suggested, ok := catalogAt(latest).cheapestFit(zone, row.NeedCores, row.NeedMemoryGB, preemptible)
+    if ok && suggested != k.machine {
+      for _, op := range ops {
+        zone, _ := splitMachineType(op.GCE.MachineType)
+        hourly := op.Hourly
+        if price, ok := catalogAt(op.StartTime).vmPrice(zone + "/" + suggested); ok {
+          hourly = currencyConf.Rates.convert(price.Hourly, currency, op.StartTime)
+        }
+        row.SuggestedCost = row.SuggestedCost.Add(hourly.Mul(op.Hours))
+      }
+      if row.SuggestedCost.Cmp(row.Cost) < 0 {
+        row.Suggested = suggested
+        row.Savings = row.Cost.Sub(row.SuggestedCost)
+      }
+    }
+    rows = append(rows, *row)
+  }
+
+  sort.Slice(rows, func(i, j int) bool {
+    return rows[i].Savings.Cmp(rows[j].Savings) > 0
+  })
+  return rows
+}
+
+// cheapestFit returns the cheapest machine type in the zone which has
+// at least the given cores and memory, at the price list's prices.
+// Shared-core machines are never suggested, and preemptible machines are
+// only suggested in place of preemptible machines.
+func (c *priceCatalog) cheapestFit(zone string, cores, memGB float64, preemptible bool) (string, bool) {
+  if cores == 0 && memGB == 0 {
+    return "", false
+  }
+  best := ""
+  var bestPrice money
+  for vm, spec := range vmSpecs {
+    if spec.Cores == 0 || spec.Cores < cores || spec.MemoryGB < memGB {
+      continue
+    }
+    if strings.HasSuffix(vm, "-preemptible") != preemptible {
+      continue
+    }
+    price, ok := c.vmPrice(zone + "/" + vm)
+    if !ok {
+      continue
+    }
+    cmp := price.Hourly.Cmp(bestPrice)
+    if best == "" || cmp < 0 || (cmp == 0 && vm < best) {
+      best = vm
+      bestPrice = price.Hourly
+    }
+  }
+  return best, best != ""
+}
+
+// loadUsageExport reads peak CPU and memory utilisation per instance from
+// a Stackdriver Monitoring timeSeries.list response saved as JSON.
+// CPU comes from compute.googleapis.com/instance/cpu/utilization and memory
+// from the monitoring agent's agent.googleapis.com/memory/percent_used.
+func loadUsageExport(path string) (map[string]instanceUsage, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  var export struct {
+    TimeSeries []struct {
+      Metric struct {
+        Type string
+        Labels map[string]string
+      }
+      Metadata struct {
+        SystemLabels map[string]interface{}
+      }
+      Points []struct {
+        Value struct {
+          DoubleValue float64
+        }
+      }
+    }
+  }
+  err = json.NewDecoder(f).Decode(&export)
+  if err != nil {
+    return nil, fmt.Errorf("reading usage export %s: %s", path, err)
+  }
+
+  usage := map[string]instanceUsage{}
+  for _, ts := range export.TimeSeries {
+    name := ts.Metric.Labels["instance_name"]
+    if name == "" {
+      name, _ = ts.Metadata.SystemLabels["name"].(string)
+    }
+    if name == "" {
+      continue
+    }
+
+    var peak float64
+    for _, p := range ts.Points {
+      if p.Value.DoubleValue > peak {
+        peak = p.Value.DoubleValue
+      }
+    }
+
+    u := usage[name]
+    switch ts.Metric.Type {
+    case "compute.googleapis.com/instance/cpu/utilization":
+      if peak > u.PeakCPU {
+        u.PeakCPU = peak
+      }
+    case "agent.googleapis.com/memory/percent_used":
+      if ts.Metric.Labels["state"] != "used" {
+        continue
+      }
+      if peak / 100 > u.PeakMemory {
+        u.PeakMemory = peak / 100
+      }
+    default:
+      continue
+    }
+    usage[name] = u
+  }
+  return usage, nil
+}
+
+var rightsizeTpl = newPage("rightsizing")
@@ -0,0 +1,490 @@
+package hello
+
+import (
+  "fmt"
+  "io/ioutil"
+  "math"
+  "net/http"
+  "os"
+  "path"
+  "regexp"
+  "sort"
+  "strings"
+
+  "google.golang.org/appengine"
+  "gopkg.in/yaml.v2"
+)
+
+// allocationRules is the cost allocation configuration, read from the YAML
+// file named by ALLOCATION_RULES:
+//
+//   labels:
+//     keys:                  # label keys to rename, matched ignoring case
+//       Lab: lab
+//       project_lab: lab
+//     values:                # clean-up of the values of a key, in this order
+//       lab:
+//         lowercase: true
+//         replace: {"_": "-"}
+//         trim_suffixes: ["-lab"]
+//         aliases: {smyth: smith}
+//   virtual:                 # labels derived from other fields, unless set
+//     - key: image
+//       from: image          # image, pipeline, zone, region, machine_type, source or api
+//       pattern: '^gcr\.io/[^/]+/([^:@]+)'   # optional, the first group is the value
+//   allocations:             # splits of the cost of matching operations
+//     - match: {lab: shared} # values are globs
+//       split:
+//         - labels: {lab: smith}
+//           percent: 60
+//         - labels: {lab: jones}
+//           percent: 40
+//
+// Operations get their labels cleaned up and virtual labels added when
+// they're listed, so every view sees them. Allocations only apply to views
+// which add up costs by label, through allocateOps.
+type allocationRules struct {
+  Labels struct {
+    Keys map[string]string `yaml:"keys"`
+    Values map[string]valueRule `yaml:"values"`
+  } `yaml:"labels"`
+  Virtual []virtualLabel `yaml:"virtual"`
+  Allocations []allocationRule `yaml:"allocations"`
+}
+
+type valueRule struct {
+  Lowercase bool `yaml:"lowercase"`
+  // Replace replaces substrings, e.g. "_" with "-".
+  Replace map[string]string `yaml:"replace"`
+  TrimSuffixes []string `yaml:"trim_suffixes"`
+  // Aliases maps whole values to the value to use instead.
+  Aliases map[string]string `yaml:"aliases"`
+}
+
+type virtualLabel struct {
+  Key string `yaml:"key"`
+  From string `yaml:"from"`
+  Pattern string `yaml:"pattern"`
+  re *regexp.Regexp
+}
+
+type allocationRule struct {
+  Match map[string]string `yaml:"match"`
+  Split []allocationSplit `yaml:"split"`
+}
+
+type allocationSplit struct {
+  Labels map[string]string `yaml:"labels"`
+  Percent float64 `yaml:"percent"`
+}
+
+// virtualFields are the fields virtual labels can be derived from.
+var virtualFields = map[string]func(op tplOp) string{
+  "image": func(op tplOp) string {
+    return op.Request.EphemeralPipeline.Docker.ImageName
+  },
+  "pipeline": func(op tplOp) string {
+    if name := op.PipelineName(); name != "(unnamed)" {
+      return name
+    }
+    return ""
+  },
+  "zone": func(op tplOp) string {
+    zone, _ := splitMachineType(op.GCE.MachineType)
+    return zone
+  },
+  "region": func(op tplOp) string {
+    zone, _ := splitMachineType(op.GCE.MachineType)
+    return regionOf(zone)
+  },
+  "machine_type": func(op tplOp) string {
+    _, machine := splitMachineType(op.GCE.MachineType)
+    return machine
+  },
+  "source": func(op tplOp) string {
+    return op.Source
+  },
+  "api": func(op tplOp) string {
+    return op.API
+  },
+}
+
+// allocConf holds the rules in ALLOCATION_RULES. It's nil when there are
+// none, which leaves operations as they are.
+var allocConf *allocationRules
+
+func init() {
+  http.HandleFunc("/rules", requireRole(roleFinance, rulesHandler))
+
+  p := os.Getenv("ALLOCATION_RULES")
+  if p == "" {
+    return
+  }
+  raw, err := ioutil.ReadFile(p)
+  if err != nil {
+    panic(err)
+  }
+  allocConf, err = parseAllocationRules(raw)
+  if err != nil {
+    panic(fmt.Errorf("%s: %s", p, err))
+  }
+}
+
+func parseAllocationRules(raw []byte) (*allocationRules, error) {
+  c := &allocationRules{}
+  if err := yaml.UnmarshalStrict(raw, c); err != nil {
+    return nil, err
+  }
+
+  for i := range c.Virtual {
+    v := &c.Virtual[i]
+    if v.Key == "" {
+      return nil, fmt.Errorf("virtual label %d: no key", i + 1)
+    }
+    if virtualFields[v.From] == nil {
+      return nil, fmt.Errorf("virtual label %s: unknown field %q", v.Key, v.From)
+    }
+    if v.Pattern != "" {
+      re, err := regexp.Compile(v.Pattern)
+      if err != nil {
+        return nil, fmt.Errorf("virtual label %s: %s", v.Key, err)
+      }
+      v.re = re
+    }
+  }
+
+  for i, a := range c.Allocations {
+    if len(a.Match) == 0 {
+      return nil, fmt.Errorf("allocation %d: nothing to match", i + 1)
+    }
+    for k, pattern := range a.Match {
+      if _, err := path.Match(pattern, ""); err != nil {
+        return nil, fmt.Errorf("allocation %d: %s: %s", i + 1, k, err)
+      }
+    }
+    total := 0.0
+    for _, s := range a.Split {
+      if s.Percent <= 0 {
+        return nil, fmt.Errorf("allocation %d: percentages must be positive", i + 1)
+      }
+      total += s.Percent
+    }
+    if math.Abs(total - 100) > 1e-9 {
+      return nil, fmt.Errorf("allocation %d: percentages add up to %g, not 100", i + 1, total)
+    }
+  }
+  return c, nil
+}
+
+// normalize returns a copy of labels with keys renamed and values cleaned
+// up. Where a label is renamed to a key which is already set, the label
+// which already had the right key wins.
+func (c *allocationRules) normalize(labels map[string]string) map[string]string {
+  if c == nil || labels == nil {
+    return labels
+  }
+  var keys []string
+  for k := range labels {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+
+  out := map[string]string{}
+  renamed := map[string]string{}
+  for _, k := range keys {
+    v := labels[k]
+    to := k
+    for from, key := range c.Labels.Keys {
+      if strings.EqualFold(k, from) {
+        to = key
+        break
+      }
+    }
+    if to == k {
+      out[k] = v
+    } else {
+      renamed[to] = v
+    }
+  }
+  for k, v := range renamed {
+    if _, ok := out[k]; !ok {
+      out[k] = v
+    }
+  }
+  for k, v := range out {
+    out[k] = c.normalizeValue(k, v)
+  }
+  return out
+}
+
+func (c *allocationRules) normalizeValue(key, v string) string {
+  rule, ok := c.Labels.Values[key]
+  if !ok {
+    return v
+  }
+  if rule.Lowercase {
+    v = strings.ToLower(v)
+  }
+  var olds []string
+  for old := range rule.Replace {
+    olds = append(olds, old)
+  }
+  sort.Strings(olds)
+  for _, old := range olds {
+    v = strings.Replace(v, old, rule.Replace[old], -1)
+  }
+  for _, s := range rule.TrimSuffixes {
+    v = strings.TrimSuffix(v, s)
+  }
+  if alias, ok := rule.Aliases[v]; ok {
+    v = alias
+  }
+  return v
+}
+
+// labels returns an operation's labels after clean-up, with virtual
+// labels added.
+func (c *allocationRules) labels(op tplOp) map[string]string {
+  if c == nil {
+    return op.Labels
+  }
+  labels := c.normalize(op.Labels)
+  if labels == nil {
+    labels = map[string]string{}
+  }
+  for _, v := range c.Virtual {
+    if _, ok := labels[v.Key]; ok {
+      continue
+    }
+    value := virtualFields[v.From](op)
+    if v.re != nil {
+      m := v.re.FindStringSubmatch(value)
+      switch {
+      case m == nil:
+        value = ""
+      case len(m) > 1:
+        value = m[1]
+      default:
+        value = m[0]
+      }
+    }
+    if value != "" {
+      labels[v.Key] = c.normalizeValue(v.Key, value)
+    }
+  }
+  return labels
+}
+
+// apply returns copies of operations with the rules applied to their labels.
+func (c *allocationRules) apply(ops []tplOp) []tplOp {
+  if c == nil {
+    return ops
+  }
+  var out []tplOp
+  for _, op := range ops {
+    op.Labels = c.labels(op)
+    out = append(out, op)
+  }
+  return out
+}
+
+// allocationShare is part of an operation charged to a set of labels.
+type allocationShare struct {
+  Labels map[string]string
+  Fraction float64
+}
+
+// shares splits an operation by the first allocation rule it matches.
+// Operations which match none make a single share with their own labels.
+func (c *allocationRules) shares(op tplOp) []allocationShare {
+  if c != nil {
+    for _, a := range c.Allocations {
+      if !a.match(op.Labels) {
+        continue
+      }
+      var shares []allocationShare
+      for _, s := range a.Split {
+        labels := map[string]string{}
+        for k, v := range op.Labels {
+          labels[k] = v
+        }
+        for k, v := range s.Labels {
+          labels[k] = v
+        }
+        shares = append(shares, allocationShare{labels, s.Percent / 100})
+      }
+      return shares
+    }
+  }
+  return []allocationShare{{op.Labels, 1}}
+}
+
+func (a allocationRule) match(labels map[string]string) bool {
+  for k, pattern := range a.Match {
+    v, ok := labels[k]
+    if !ok {
+      return false
+    }
+    if ok, _ := path.Match(pattern, v); !ok {
+      return false
+    }
+  }
+  return true
+}
+
+// allocate splits operations into their shares. Each share's hours and
+// cost are its fraction of the operation's; the last share gets what's
+// left of the cost, so the shares add up to it exactly.
+func (c *allocationRules) allocate(ops []tplOp) []tplOp {
+  var out []tplOp
+  for _, op := range ops {
+    shares := c.shares(op)
+    left := op.Cost
+    for i, s := range shares {
+      part := op
+      part.Labels = s.Labels
+      part.Share = s.Fraction
+      part.Hours = op.Hours * s.Fraction
+      part.Cost = op.Cost.Mul(s.Fraction)
+      if i == len(shares) - 1 {
+        part.Cost = left
+      }
+      left = left.Sub(part.Cost)
+      out = append(out, part)
+    }
+  }
+  return out
+}
+
+// allocateOps splits operations into their shares with the configured
+// rules, for views which add up costs by label.
+func allocateOps(ops []tplOp) []tplOp {
+  return allocConf.allocate(ops)
+}
+
+// rulePreview shows what a set of rules does to each operation, and to
+// the cost of each label.
+type rulePreview struct {
+  Rows []previewRow
+  ByLabel []previewLabel
+}
+
+type previewRow struct {
+  Name string
+  Before []string
+  After []string
+  Shares []tplOp
+  Changed bool
+}
+
+// previewLabel is the cost of a key=value label before the rules are
+// applied and after, with allocations.
+type previewLabel struct {
+  Label string
+  Before money
+  After money
+}
+
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listSourceOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  // Rules posted from the page are a draft, which is previewed but
+  // not saved. Otherwise the rules in use are shown.
+  var raw []byte
+  draft := r.Method == http.MethodPost
+  if draft {
+    raw = []byte(r.FormValue("rules"))
+  } else if p := os.Getenv("ALLOCATION_RULES"); p != "" {
+    raw, err = ioutil.ReadFile(p)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
+      return
+    }
+  }
+
+  data := struct {
+    Project string
+    Rules string
+    Draft bool
+    Error string
+    Preview rulePreview
+  }{
+    Project: project,
+    Rules: string(raw),
+    Draft: draft,
+  }
+  rules, err := parseAllocationRules(raw)
+  if err != nil {
+    data.Error = err.Error()
+  } else {
+    data.Preview = previewRules(rules, convertOps(ops, requestCurrency(r)))
+  }
+
+  err = render(w, r, rulesTpl, "Allocation Rules", data)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// previewRules applies rules to operations as they came from their source.
+func previewRules(rules *allocationRules, ops []tplOp) rulePreview {
+  var p rulePreview
+  byLabel := map[string]*previewLabel{}
+  add := func(label string, before, after money) {
+    l, ok := byLabel[label]
+    if !ok {
+      l = &previewLabel{Label: label}
+      byLabel[label] = l
+    }
+    l.Before = l.Before.Add(before)
+    l.After = l.After.Add(after)
+  }
+
+  for _, op := range ops {
+    applied := rules.apply([]tplOp{op})
+    shares := rules.allocate(applied)
+    row := previewRow{
+      Name: op.Name,
+      Before: op.LabelList(),
+      After: applied[0].LabelList(),
+      Shares: shares,
+    }
+    row.Changed = len(shares) > 1 || strings.Join(row.Before, ",") != strings.Join(row.After, ",")
+    p.Rows = append(p.Rows, row)
+
+    if op.Cost.Unknown() {
+      continue
+    }
+    for _, l := range row.Before {
+      add(l, op.Cost, money{})
+    }
+    for _, s := range shares {
+      for _, l := range s.LabelList() {
+        add(l, money{}, s.Cost)
+      }
+    }
+  }
+
+  for _, l := range byLabel {
+    p.ByLabel = append(p.ByLabel, *l)
+  }
+  sort.Slice(p.ByLabel, func(i, j int) bool {
+    return p.ByLabel[i].Label < p.ByLabel[j].Label
+  })
+  return p
+}
+
+var rulesTpl = newPage("rules")
@@ -0,0 +1,265 @@
+package hello
+
+import (
+  "fmt"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "time"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/storage", requireRole(roleFinance, storageHandler))
+}
+
+// storageRow is the storage left behind by a group of operations,
+// and what it costs to keep each month.
+type storageRow struct {
+  Key string
+  Objects int
+  Bytes int64
+  MonthlyCost money
+}
+
+type storageReport struct {
+  ByWorkflow []storageRow
+  ByLabel []storageRow
+  Objects int
+  Bytes int64
+  MonthlyCost money
+  // Unpriced counts objects whose storage class or location has no price.
+  Unpriced int
+  Errors []string
+}
+
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  gcs, err := newGCSClient(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+  if path := os.Getenv("GCS_LISTING"); path != "" {
+    objects, err := loadGsutilListing(path)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
+      return
+    }
+    gcs = importedListing{objects, gcs}
+  }
+  locations, err := parsePairs(os.Getenv("BUCKET_LOCATIONS"))
+  if err != nil {
+    fmt.Fprintln(w, "BUCKET_LOCATIONS:", err.Error())
+    return
+  }
+  gcs = staticBucketLocations{locations, gcs}
+
+  err = render(w, r, storageTpl, "Storage", struct {
+    Project string
+    Report storageReport
+  }{
+    Project: project,
+    Report: storageCosts(ops, gcs, requestCurrency(r)),
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// storageOutput is an output location of an operation. Prefix is the
+// object name, or for wildcard and directory outputs, the name prefix.
+type storageOutput struct {
+  Bucket string
+  Prefix string
+  Op tplOp
+}
+
+func (o storageOutput) match(obj gcsObject) bool {
+  if obj.Bucket != o.Bucket {
+    return false
+  }
+  return obj.Name == o.Prefix ||
+    (strings.HasSuffix(o.Prefix, "/") && strings.HasPrefix(obj.Name, o.Prefix)) ||
+    strings.HasPrefix(obj.Name, o.Prefix + "/")
+}
+
+// storageCosts lists the objects under each operation's gs:// outputs and
+// attributes each object to the most specific output it falls under, or if
+// several operations wrote to the same place, the one which ran last.
+// Objects are priced with the price list in effect when the operation which
+// wrote them started, and monthly costs are converted to currency at today's
+// rate.
+func storageCosts(ops []tplOp, gcs gcsClient, currency string) storageReport {
+  var outputs []storageOutput
+  for _, op := range ops {
+    for _, p := range op.Request.PipelineArgs.Outputs {
+      bucket, object, ok := parseGCSPath(p)
+      if !ok {
+        continue
+      }
+      // Wildcard outputs like "gs://bucket/dir/*" match everything in dir.
+      if i := strings.Index(object, "*"); i != -1 {
+        object = object[:i]
+      }
+      outputs = append(outputs, storageOutput{bucket, object, op})
+    }
+  }
+
+  report := storageReport{}
+
+  objects := map[string]gcsObject{}
+  listed := map[string]bool{}
+  for _, out := range outputs {
+    if listed[out.Bucket + "/" + out.Prefix] {
+      continue
+    }
+    listed[out.Bucket + "/" + out.Prefix] = true
+
+    objs, err := gcs.ListObjects(out.Bucket, out.Prefix)
+    if err != nil {
+      report.Errors = append(report.Errors, err.Error())
+      continue
+    }
+    for _, o := range objs {
+      objects[o.Path()] = o
+    }
+  }
+
+  byWorkflow := map[string]*storageRow{}
+  byLabel := map[string]*storageRow{}
+  add := func(m map[string]*storageRow, key string, obj gcsObject, cost money) {
+    row, ok := m[key]
+    if !ok {
+      row = &storageRow{Key: key}
+      m[key] = row
+    }
+    row.Objects++
+    row.Bytes += obj.Size
+    row.MonthlyCost = row.MonthlyCost.Add(cost)
+  }
+
+  for _, obj := range objects {
+    var owner *storageOutput
+    for i, out := range outputs {
+      if !out.match(obj) {
+        continue
+      }
+      if owner == nil || len(out.Prefix) > len(owner.Prefix) ||
+        (len(out.Prefix) == len(owner.Prefix) && out.Op.StartTime.After(owner.Op.StartTime)) {
+        owner = &outputs[i]
+      }
+    }
+    if owner == nil {
+      continue
+    }
+
+    var cost money
+    loc, err := gcs.BucketLocation(obj.Bucket)
+    rate, ok := catalogAt(owner.Op.StartTime).storageRate(obj.StorageClass, loc)
+    if err != nil || !ok {
+      report.Unpriced++
+    } else {
+      cost = currencyConf.Rates.convert(usd(float64(obj.Size) / bytesPerGB * rate), currency, time.Now())
+    }
+
+    report.Objects++
+    report.Bytes += obj.Size
+    report.MonthlyCost = report.MonthlyCost.Add(cost)
+    add(byWorkflow, owner.Op.Workflow(), obj, cost)
+    for _, share := range allocConf.shares(owner.Op) {
+      for k, v := range share.Labels {
+        add(byLabel, k + "=" + v, obj, cost.Mul(share.Fraction))
+      }
+    }
+  }
+
+  report.ByWorkflow = sortedStorageRows(byWorkflow)
+  report.ByLabel = sortedStorageRows(byLabel)
+  return report
+}
+
+func sortedStorageRows(m map[string]*storageRow) []storageRow {
+  var rows []storageRow
+  for _, row := range m {
+    rows = append(rows, *row)
+  }
+  sort.Slice(rows, func(i, j int) bool {
+    if c := rows[i].MonthlyCost.Cmp(rows[j].MonthlyCost); c != 0 {
+      return c > 0
+    }
+    return rows[i].Key < rows[j].Key
+  })
+  return rows
+}
+
+// storageRate returns the price per GB-month of a storage class in a bucket
+// location. Standard storage, and objects whose class isn't known, are
+// priced as multi-regional or regional depending on the location.
+func (c *priceCatalog) storageRate(class, location string) (float64, bool) {
+  loc := strings.ToLower(location)
+  multi := !strings.Contains(loc, "-")
+
+  class = strings.ToUpper(class)
+  if class == "" || class == "STANDARD" {
+    class = "REGIONAL"
+    if multi {
+      class = "MULTI_REGIONAL"
+    }
+  }
+
+  var key string
+  switch class {
+  case "MULTI_REGIONAL":
+    key = "CP-BIGSTORE-STORAGE"
+  case "REGIONAL":
+    key = "CP-BIGSTORE-STORAGE-REGIONAL"
+  case "NEARLINE":
+    key = "CP-NEARLINE-STORAGE"
+  case "COLDLINE":
+    key = "CP-BIGSTORE-STORAGE-COLDLINE"
+  case "DURABLE_REDUCED_AVAILABILITY":
+    key = "CP-BIGSTORE-STORAGE-DRA"
+  default:
+    return 0, false
+  }
+
+  // Storage prices are listed by region, by multi-region, or for
+  // some classes only once, under "us". Locations without a price of
+  // their own are unpriced rather than priced as "us".
+  candidates := []string{loc, strings.TrimSuffix(loc, "1")}
+  switch continentOf(loc) {
+  case "eu":
+    candidates = append(candidates, "europe")
+  case "apac":
+    candidates = append(candidates, "asia")
+  }
+  for _, r := range candidates {
+    if rate, ok := c.flatPrice(key, r); ok {
+      return rate, true
+    }
+  }
+  entry, _ := c.PriceList[key].(map[string]interface{})
+  if len(entry) == 1 {
+    return c.flatPrice(key, "us")
+  }
+  return 0, false
+}
+
+var storageTpl = newPage("storage")
@@ -0,0 +1,199 @@
+package hello
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+// tesClient lists tasks from a GA4GH Task Execution Service, such as
+// Funnel. URL is the server's base URL, e.g. "http://localhost:8000".
+// Client defaults to http.DefaultClient.
+type tesClient struct {
+  URL string
+  Client *http.Client
+}
+
+// tesTask is the subset of a TES v1 task, in the FULL view,
+// which the dashboard cares about.
+type tesTask struct {
+  ID string `json:"id"`
+  State string `json:"state"`
+  Name string `json:"name"`
+  Resources struct {
+    CPUCores float64 `json:"cpu_cores"`
+    RamGb float64 `json:"ram_gb"`
+    Preemptible bool `json:"preemptible"`
+    Zones []string `json:"zones"`
+  } `json:"resources"`
+  Executors []struct {
+    Image string `json:"image"`
+    Command []string `json:"command"`
+  } `json:"executors"`
+  Inputs []tesFile `json:"inputs"`
+  Outputs []tesFile `json:"outputs"`
+  Tags map[string]string `json:"tags"`
+  Logs []tesTaskLog `json:"logs"`
+  CreationTime string `json:"creation_time"`
+}
+
+type tesFile struct {
+  Name string `json:"name"`
+  URL string `json:"url"`
+  Path string `json:"path"`
+}
+
+// tesTaskLog is the log of one attempt at running a task.
+type tesTaskLog struct {
+  StartTime string `json:"start_time"`
+  EndTime string `json:"end_time"`
+  // Metadata is whatever the server wants to say about where the task ran.
+  Metadata map[string]string `json:"metadata"`
+  SystemLogs []string `json:"system_logs"`
+}
+
+func (c tesClient) listTasks() ([]tesTask, error) {
+  client := c.Client
+  if client == nil {
+    client = http.DefaultClient
+  }
+
+  var tasks []tesTask
+  pageToken := ""
+  for {
+    q := url.Values{}
+    q.Set("view", "FULL")
+    if pageToken != "" {
+      q.Set("page_token", pageToken)
+    }
+
+    resp, err := client.Get(strings.TrimSuffix(c.URL, "/") + "/v1/tasks?" + q.Encode())
+    if err != nil {
+      return nil, err
+    }
+    var page struct {
+      Tasks []tesTask `json:"tasks"`
+      NextPageToken string `json:"next_page_token"`
+    }
+    if resp.StatusCode != http.StatusOK {
+      err = fmt.Errorf("TES server %s: %s", c.URL, resp.Status)
+    } else {
+      err = json.NewDecoder(resp.Body).Decode(&page)
+    }
+    resp.Body.Close()
+    if err != nil {
+      return nil, err
+    }
+
+    tasks = append(tasks, page.Tasks...)
+    if page.NextPageToken == "" {
+      return tasks, nil
+    }
+    pageToken = page.NextPageToken
+  }
+}
+
+// tesMachineTypeKeys and tesZoneKeys are the task log metadata keys
+// which servers use to say which VM a task ran on.
+var tesMachineTypeKeys = []string{"machine_type", "machineType", "instance_type"}
+var tesZoneKeys = []string{"zone", "availability_zone"}
+
+// tesRecords turns TES tasks into operations. Tasks run on the VM of
+// their last attempt; if the server doesn't say which machine type that
+// was, it's taken to be the cheapest one which fits the task's resources,
+// which is what an autoscaling worker pool would start for it.
+func tesRecords(tasks []tesTask) []opRecord {
+  var recs []opRecord
+  for _, t := range tasks {
+    rec := opRecord{
+      Name: t.ID,
+      API: "tes/v1",
+      Source: sourceLive,
+      Labels: t.Tags,
+    }
+    rec.CreateTime, _ = time.Parse(time.RFC3339, t.CreationTime)
+
+    switch t.State {
+    case "COMPLETE":
+      rec.Done = true
+    case "EXECUTOR_ERROR", "SYSTEM_ERROR", "CANCELED":
+      rec.Done = true
+      rec.Error = strings.ToLower(strings.Replace(t.State, "_", " ", -1))
+    }
+
+    req := pipelineRequest{}
+    req.EphemeralPipeline.Name = t.Name
+    res := &req.EphemeralPipeline.Resources
+    res.MinimumCpuCores = t.Resources.CPUCores
+    res.MinimumRamGb = t.Resources.RamGb
+    res.Preemptible = t.Resources.Preemptible
+    res.Zones = t.Resources.Zones
+    if len(t.Executors) != 0 {
+      req.EphemeralPipeline.Docker.ImageName = t.Executors[0].Image
+      req.EphemeralPipeline.Docker.Cmd = strings.Join(t.Executors[0].Command, " ")
+    }
+    req.PipelineArgs.Inputs = tesFileMap(t.Inputs)
+    req.PipelineArgs.Outputs = tesFileMap(t.Outputs)
+    req.PipelineArgs.Labels = t.Tags
+    rec.Request = req
+
+    if len(t.Logs) != 0 {
+      log := t.Logs[len(t.Logs) - 1]
+      rec.StartTime, _ = time.Parse(time.RFC3339, log.StartTime)
+      rec.EndTime, _ = time.Parse(time.RFC3339, log.EndTime)
+      if rec.Error != "" && len(log.SystemLogs) != 0 {
+        rec.Error += ": " + log.SystemLogs[len(log.SystemLogs) - 1]
+      }
+
+      zone := firstValue(log.Metadata, tesZoneKeys)
+      if zone == "" && len(t.Resources.Zones) != 0 {
+        zone = t.Resources.Zones[0]
+      }
+      machine := firstValue(log.Metadata, tesMachineTypeKeys)
+      if machine == "" {
+        machine, _ = catalogAt(rec.StartTime).cheapestFit(zone, t.Resources.CPUCores, t.Resources.RamGb, t.Resources.Preemptible)
+      }
+      rec.GCE.Zone = zone
+      rec.GCE.MachineType = zone + "/" + preemptibleMachine(machine, t.Resources.Preemptible)
+      rec.GCE.InstanceName = log.Metadata["hostname"]
+    }
+
+    rec.RawRequest, _ = json.Marshal(struct {
+      Name string `json:"name"`
+      Resources interface{} `json:"resources"`
+      Executors interface{} `json:"executors"`
+      Inputs []tesFile `json:"inputs"`
+      Outputs []tesFile `json:"outputs"`
+    }{t.Name, t.Resources, t.Executors, t.Inputs, t.Outputs})
+    rec.RawRuntime, _ = json.Marshal(t.Logs)
+
+    recs = append(recs, rec)
+  }
+  return recs
+}
+
+// tesFileMap maps a task's input or output names, or where there's no
+// name, container paths, to their URLs.
+func tesFileMap(files []tesFile) map[string]string {
+  m := map[string]string{}
+  for _, f := range files {
+    key := f.Name
+    if key == "" {
+      key = f.Path
+    }
+    m[key] = f.URL
+  }
+  return m
+}
+
+func firstValue(m map[string]string, keys []string) string {
+  for _, k := range keys {
+    if v := m[k]; v != "" {
+      return v
+    }
+  }
+  return ""
+}
@@ -0,0 +1,142 @@
+package hello
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "testing"
+  "time"
+)
+
+// fakeTES serves tasks a page at a time, like Funnel, and records the
+// queries it was sent.
+func fakeTES(pages [][]map[string]interface{}) (*httptest.Server, *[]string) {
+  var queries []string
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/v1/tasks" {
+      http.NotFound(w, r)
+      return
+    }
+    queries = append(queries, r.URL.RawQuery)
+    i := 0
+    if tok := r.URL.Query().Get("page_token"); tok != "" {
+      json.Unmarshal([]byte(tok), &i)
+    }
+    resp := map[string]interface{}{"tasks": pages[i]}
+    if i + 1 < len(pages) {
+      tok, _ := json.Marshal(i + 1)
+      resp["next_page_token"] = string(tok)
+    }
+    json.NewEncoder(w).Encode(resp)
+  }))
+  return srv, &queries
+}
+
+func tesTaskJSON(id, state string, preemptible bool, log map[string]interface{}) map[string]interface{} {
+  task := map[string]interface{}{
+    "id": id,
+    "state": state,
+    "name": "align",
+    "creation_time": "2018-03-01T10:00:00Z",
+    "resources": map[string]interface{}{"cpu_cores": 1, "ram_gb": 3.75, "preemptible": preemptible},
+    "executors": []interface{}{map[string]interface{}{"image": "gcr.io/p/bwa:1", "command": []string{"bwa", "mem"}}},
+    "tags": map[string]string{"lab": "smith"},
+  }
+  if log != nil {
+    task["logs"] = []interface{}{log}
+  }
+  return task
+}
+
+func TestTESListTasks(t *testing.T) {
+  ran := map[string]interface{}{
+    "start_time": "2018-03-01T10:05:00Z",
+    "end_time": "2018-03-01T11:05:00Z",
+    "metadata": map[string]string{"machine_type": "n1-standard-1", "zone": "us-central1-f", "hostname": "worker-1"},
+    "system_logs": []string{"disk full"},
+  }
+  srv, queries := fakeTES([][]map[string]interface{}{
+    {
+      tesTaskJSON("bdgd3ibl0uu6cn1bk4ag", "COMPLETE", false, ran),
+      tesTaskJSON("bdgd3ibl0uu6cn1bk4b0", "COMPLETE", true, ran),
+    },
+    {
+      tesTaskJSON("bdgd3ibl0uu6cn1bk4bg", "EXECUTOR_ERROR", false, ran),
+      tesTaskJSON("bdgd3ibl0uu6cn1bk4c0", "RUNNING", false, map[string]interface{}{"start_time": "2018-03-01T10:05:00Z"}),
+    },
+    {
+      tesTaskJSON("bdgd3ibl0uu6cn1bk4cg", "QUEUED", false, nil),
+      tesTaskJSON("bdgd3ibl0uu6cn1bk4d0", "CANCELED", false, nil),
+    },
+  })
+  defer srv.Close()
+
+  tasks, err := tesClient{URL: srv.URL + "/", Client: srv.Client()}.listTasks()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(tasks) != 6 || len(*queries) != 3 {
+    t.Fatalf("got %d tasks in %d requests, want 6 in 3", len(tasks), len(*queries))
+  }
+  for _, q := range *queries {
+    if v, _ := url.ParseQuery(q); v.Get("view") != "FULL" {
+      t.Errorf("query %q doesn't ask for the FULL view", q)
+    }
+  }
+  if len(tasks[0].Executors) != 1 || tasks[0].Executors[0].Image != "gcr.io/p/bwa:1" || tasks[0].Logs[0].Metadata["hostname"] != "worker-1" {
+    t.Errorf("FULL view fields not parsed: %+v", tasks[0])
+  }
+
+  ops, pending := priceOps(tesRecords(tasks), time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC))
+  if len(pending) != 1 || pending[0].Name != "bdgd3ibl0uu6cn1bk4cg" {
+    t.Fatalf("pending = %+v", pending)
+  }
+  byName := map[string]tplOp{}
+  for _, op := range ops {
+    byName[op.Name] = op
+  }
+  if len(byName) != 5 {
+    t.Fatalf("%d distinct operation names, want 5: IDs collided", len(byName))
+  }
+
+  for _, c := range []struct {
+    id string
+    status string
+    error string
+  }{
+    {"bdgd3ibl0uu6cn1bk4ag", "succeeded", ""},
+    {"bdgd3ibl0uu6cn1bk4b0", "succeeded", ""},
+    {"bdgd3ibl0uu6cn1bk4bg", "failed", "executor error: disk full"},
+    {"bdgd3ibl0uu6cn1bk4c0", "running", ""},
+    {"bdgd3ibl0uu6cn1bk4d0", "failed", "canceled"},
+  } {
+    op, ok := byName[c.id]
+    if !ok {
+      t.Errorf("%s: missing", c.id)
+      continue
+    }
+    if op.Status() != c.status || op.Error != c.error {
+      t.Errorf("%s: status %q, error %q; want %q, %q", c.id, op.Status(), op.Error, c.status, c.error)
+    }
+  }
+
+  onDemand, preemptible := byName["bdgd3ibl0uu6cn1bk4ag"], byName["bdgd3ibl0uu6cn1bk4b0"]
+  if onDemand.GCE.MachineType != "us-central1-f/n1-standard-1" || preemptible.GCE.MachineType != "us-central1-f/n1-standard-1-preemptible" {
+    t.Errorf("machine types %q and %q", onDemand.GCE.MachineType, preemptible.GCE.MachineType)
+  }
+  want, ok := catalogAt(preemptible.StartTime).vmPrice(preemptible.GCE.MachineType)
+  if !ok || preemptible.Hourly.Cmp(want.Hourly) != 0 || preemptible.Hourly.Cmp(onDemand.Hourly) >= 0 {
+    t.Errorf("preemptible hourly price %s, on-demand %s, want the preemptible price %s", preemptible.Hourly, onDemand.Hourly, want.Hourly)
+  }
+}
+
+func TestTESServerError(t *testing.T) {
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, "down", http.StatusServiceUnavailable)
+  }))
+  defer srv.Close()
+  if _, err := (tesClient{URL: srv.URL, Client: srv.Client()}).listTasks(); err == nil {
+    t.Error("expected an error from a failing server")
+  }
+}
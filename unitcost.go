@@ -0,0 +1,427 @@
+package hello
+
+import (
+  "fmt"
+  "math"
+  "net/http"
+  "os"
+  "regexp"
+  "sort"
+  "strings"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/unitcost", requireRole(roleViewer, unitCostHandler))
+}
+
+// unitCostConfig says how to find the sample an operation processed and
+// the size of its inputs. It's read from:
+//
+//   SAMPLE_LABELS         label keys holding sample IDs, in order of preference,
+//                         "sample,sample-id,sample_id" by default
+//   SAMPLE_INPUT_PATTERN  a regexp whose first group is the sample ID in an input
+//                         path, e.g. `/([^/]+)\.bam$`, for operations without one
+//                         of the labels
+//   INPUT_SIZES           a CSV file of path,bytes lines, like EGRESS_MANIFEST
+//   INPUT_SIZE_LOOKUP     "gcs" to look up sizes which aren't in INPUT_SIZES in
+//                         Cloud Storage, or in GCS_LISTING if it's set
+type unitCostConfig struct {
+  SampleLabels []string
+  SamplePattern *regexp.Regexp
+  Sizes map[string]int64
+  // Lookup finds sizes missing from Sizes. It may be nil.
+  Lookup gcsClient
+}
+
+func loadUnitCostConfig() (unitCostConfig, error) {
+  c := unitCostConfig{
+    SampleLabels: []string{"sample", "sample-id", "sample_id"},
+    Sizes: map[string]int64{},
+  }
+  if s := os.Getenv("SAMPLE_LABELS"); s != "" {
+    c.SampleLabels = nil
+    for _, k := range strings.Split(s, ",") {
+      if k = strings.TrimSpace(k); k != "" {
+        c.SampleLabels = append(c.SampleLabels, k)
+      }
+    }
+  }
+  if s := os.Getenv("SAMPLE_INPUT_PATTERN"); s != "" {
+    re, err := regexp.Compile(s)
+    if err != nil {
+      return c, fmt.Errorf("SAMPLE_INPUT_PATTERN: %s", err)
+    }
+    if re.NumSubexp() < 1 {
+      return c, fmt.Errorf("SAMPLE_INPUT_PATTERN: %q has no group for the sample ID", s)
+    }
+    c.SamplePattern = re
+  }
+  if path := os.Getenv("INPUT_SIZES"); path != "" {
+    sizes, err := loadSizeManifest(path)
+    if err != nil {
+      return c, err
+    }
+    c.Sizes = sizes
+  }
+  return c, nil
+}
+
+// sample returns the ID of the sample an operation processed, from its
+// labels or failing that, its inputs.
+func (c unitCostConfig) sample(op tplOp) string {
+  for _, k := range c.SampleLabels {
+    if v := op.Labels[k]; v != "" {
+      return v
+    }
+  }
+  if c.SamplePattern == nil {
+    return ""
+  }
+  var paths []string
+  for _, p := range op.Request.PipelineArgs.Inputs {
+    paths = append(paths, p)
+  }
+  sort.Strings(paths)
+  for _, p := range paths {
+    if m := c.SamplePattern.FindStringSubmatch(p); m != nil && m[1] != "" {
+      return m[1]
+    }
+  }
+  return ""
+}
+
+// inputSize finds the size of an input path, which may be a directory or
+// a wildcard, as for outputs in the storage view.
+func (c unitCostConfig) inputSize(p string, cache map[string]int64) (int64, error) {
+  if n, ok := c.Sizes[p]; ok {
+    return n, nil
+  }
+  if n, ok := cache[p]; ok {
+    return n, nil
+  }
+  bucket, object, ok := parseGCSPath(p)
+  if !ok || c.Lookup == nil {
+    return 0, fmt.Errorf("unknown size of input %s", p)
+  }
+  if i := strings.Index(object, "*"); i != -1 {
+    object = object[:i]
+  }
+  objs, err := c.Lookup.ListObjects(bucket, object)
+  if err != nil {
+    return 0, err
+  }
+  out := storageOutput{Bucket: bucket, Prefix: object}
+  var n int64
+  found := false
+  for _, o := range objs {
+    if out.match(o) {
+      n += o.Size
+      found = true
+    }
+  }
+  if !found {
+    return 0, fmt.Errorf("input %s not found", p)
+  }
+  cache[p] = n
+  return n, nil
+}
+
+// sampleCost is what processing one sample with one pipeline cost.
+type sampleCost struct {
+  Pipeline string
+  Sample string
+  Ops int
+  Cost money
+  InputBytes int64
+  // SizeKnown is false when the size of any of the inputs isn't known.
+  SizeKnown bool
+  // PerGB is the cost per GB of input, which is unknown if the size is.
+  PerGB money
+  // Outlier is "high" or "low" for samples which cost unusually much or
+  // little per sample for their pipeline.
+  Outlier string
+}
+
+// unitDistribution summarises a unit cost over a pipeline's samples.
+type unitDistribution struct {
+  Count int
+  Min money
+  P50 money
+  Mean money
+  P95 money
+  Max money
+  Histogram []histogramBin
+}
+
+type histogramBin struct {
+  From money
+  To money
+  Count int
+  // Width is the bar width, as a percentage of the fullest bin's.
+  Width int
+}
+
+// histogramBins is how many bins distributions are shown with.
+const histogramBins = 10
+
+type pipelineUnitCost struct {
+  Pipeline string
+  Samples int
+  PerSample unitDistribution
+  PerGB unitDistribution
+  // TotalPerGB is the cost of the samples with known sizes over the
+  // total size of their inputs.
+  TotalPerGB money
+  // Unsampled counts operations whose sample couldn't be found, and
+  // Unknown those whose cost is unknown. Neither is in the distributions.
+  Unsampled int
+  UnsampledCost money
+  Unknown int
+  Outliers []sampleCost
+}
+
+type unitCostReport struct {
+  Pipelines []pipelineUnitCost
+  Samples []sampleCost
+  Errors []string
+}
+
+func unitCostHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  conf, err := loadUnitCostConfig()
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+  if os.Getenv("INPUT_SIZE_LOOKUP") == "gcs" {
+    conf.Lookup, err = newGCSClient(ctx)
+    if err != nil {
+      fmt.Fprintln(w, err.Error())
+      return
+    }
+    if path := os.Getenv("GCS_LISTING"); path != "" {
+      objects, err := loadGsutilListing(path)
+      if err != nil {
+        fmt.Fprintln(w, err.Error())
+        return
+      }
+      conf.Lookup = importedListing{objects, conf.Lookup}
+    }
+  }
+
+  filter := parseOpFilter(r)
+  currency := requestCurrency(r)
+  err = render(w, r, unitCostTpl, "Unit Costs", struct {
+    Project string
+    Filter opFilter
+    Report unitCostReport
+  }{
+    Project: project,
+    Filter: filter,
+    Report: unitCosts(convertOps(filterOps(ops, filter), currency), conf, currency),
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// unitCosts adds up the cost of each sample by pipeline, and describes
+// how much samples cost, and cost per GB of input, in each pipeline.
+// An input used by several operations of a sample is only counted once.
+func unitCosts(ops []tplOp, conf unitCostConfig, currency string) unitCostReport {
+  report := unitCostReport{}
+  pipelines := map[string]*pipelineUnitCost{}
+  samples := map[[2]string]*sampleCost{}
+  inputs := map[[2]string]map[string]bool{}
+  sizes := map[string]int64{}
+  failed := map[string]bool{}
+
+  for _, op := range ops {
+    name := op.PipelineName()
+    p, ok := pipelines[name]
+    if !ok {
+      p = &pipelineUnitCost{Pipeline: name}
+      pipelines[name] = p
+    }
+    if op.Cost.Unknown() {
+      p.Unknown++
+      continue
+    }
+    id := conf.sample(op)
+    if id == "" {
+      p.Unsampled++
+      p.UnsampledCost = p.UnsampledCost.Add(op.Cost)
+      continue
+    }
+
+    k := [2]string{name, id}
+    s, ok := samples[k]
+    if !ok {
+      s = &sampleCost{Pipeline: name, Sample: id, SizeKnown: true}
+      samples[k] = s
+      inputs[k] = map[string]bool{}
+    }
+    s.Ops++
+    s.Cost = s.Cost.Add(op.Cost)
+    for _, in := range op.Request.PipelineArgs.Inputs {
+      if inputs[k][in] {
+        continue
+      }
+      inputs[k][in] = true
+      n, err := conf.inputSize(in, sizes)
+      if err != nil {
+        s.SizeKnown = false
+        if !failed[in] {
+          failed[in] = true
+          report.Errors = append(report.Errors, err.Error())
+        }
+        continue
+      }
+      s.InputBytes += n
+    }
+  }
+
+  bySample := map[string][]*sampleCost{}
+  for _, s := range samples {
+    s.PerGB = unknownMoney
+    if s.SizeKnown && s.InputBytes > 0 {
+      s.PerGB = s.Cost.Mul(bytesPerGB / float64(s.InputBytes))
+    }
+    bySample[s.Pipeline] = append(bySample[s.Pipeline], s)
+  }
+
+  for name, p := range pipelines {
+    ss := bySample[name]
+    sort.Slice(ss, func(i, j int) bool {
+      return ss[i].Sample < ss[j].Sample
+    })
+    p.Samples = len(ss)
+
+    var perSample, perGB []float64
+    var knownCost money
+    var knownBytes int64
+    for _, s := range ss {
+      perSample = append(perSample, s.Cost.Float())
+      if !s.PerGB.Unknown() {
+        perGB = append(perGB, s.PerGB.Float())
+        knownCost = knownCost.Add(s.Cost)
+        knownBytes += s.InputBytes
+      }
+    }
+    p.PerSample = distribution(perSample, currency)
+    p.PerGB = distribution(perGB, currency)
+    p.TotalPerGB = unknownMoney
+    if knownBytes > 0 {
+      p.TotalPerGB = knownCost.Mul(bytesPerGB / float64(knownBytes))
+    }
+
+    low, high := tukeyFences(perSample)
+    for _, s := range ss {
+      switch c := s.Cost.Float(); {
+      case c > high:
+        s.Outlier = "high"
+      case c < low:
+        s.Outlier = "low"
+      }
+      if s.Outlier != "" {
+        p.Outliers = append(p.Outliers, *s)
+      }
+      report.Samples = append(report.Samples, *s)
+    }
+    report.Pipelines = append(report.Pipelines, *p)
+  }
+
+  sort.Slice(report.Pipelines, func(i, j int) bool {
+    return report.Pipelines[i].Pipeline < report.Pipelines[j].Pipeline
+  })
+  sort.Slice(report.Samples, func(i, j int) bool {
+    a, b := report.Samples[i], report.Samples[j]
+    if a.Pipeline != b.Pipeline {
+      return a.Pipeline < b.Pipeline
+    }
+    return a.Sample < b.Sample
+  })
+  sort.Strings(report.Errors)
+  return report
+}
+
+// distribution summarises values, which are amounts in currency.
+func distribution(values []float64, currency string) unitDistribution {
+  d := unitDistribution{Count: len(values)}
+  if len(values) == 0 {
+    return d
+  }
+  sorted := append([]float64(nil), values...)
+  sort.Float64s(sorted)
+  sum := 0.0
+  for _, v := range sorted {
+    sum += v
+  }
+  min, max := sorted[0], sorted[len(sorted) - 1]
+  d.Min = newMoney(min, currency)
+  d.P50 = newMoney(sorted[percentileIndex(len(sorted), 50)], currency)
+  d.Mean = newMoney(sum / float64(len(sorted)), currency)
+  d.P95 = newMoney(sorted[percentileIndex(len(sorted), 95)], currency)
+  d.Max = newMoney(max, currency)
+
+  width := (max - min) / histogramBins
+  counts := make([]int, histogramBins)
+  for _, v := range sorted {
+    i := histogramBins - 1
+    if width > 0 {
+      i = int(math.Min((v - min) / width, histogramBins - 1))
+    }
+    counts[i]++
+  }
+  most := 0
+  for _, n := range counts {
+    if n > most {
+      most = n
+    }
+  }
+  for i, n := range counts {
+    if width == 0 && n == 0 {
+      continue
+    }
+    d.Histogram = append(d.Histogram, histogramBin{
+      From: newMoney(min + float64(i) * width, currency),
+      To: newMoney(min + float64(i + 1) * width, currency),
+      Count: n,
+      Width: n * 100 / most,
+    })
+  }
+  return d
+}
+
+// tukeyFences returns the bounds outside which values are outliers:
+// 1.5 interquartile ranges below the first quartile and above the third.
+// With fewer than four values nothing is an outlier.
+func tukeyFences(values []float64) (float64, float64) {
+  if len(values) < 4 {
+    return math.Inf(-1), math.Inf(1)
+  }
+  sorted := append([]float64(nil), values...)
+  sort.Float64s(sorted)
+  q1 := sorted[percentileIndex(len(sorted), 25)]
+  q3 := sorted[percentileIndex(len(sorted), 75)]
+  iqr := q3 - q1
+  return q1 - 1.5 * iqr, q3 + 1.5 * iqr
+}
+
+var unitCostTpl = newPage("unitcost")
@@ -0,0 +1,145 @@
+package hello
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+
+  "google.golang.org/appengine"
+)
+
+func init() {
+  http.HandleFunc("/whatif", requireRole(roleViewer, whatifHandler))
+}
+
+// repricing is a change to how operations are run, e.g. "on n1-standard-4
+// in europe-west1, preemptible". Empty fields leave that part unchanged.
+type repricing struct {
+  Machine string
+  Region string
+  // Preemptible is "on", "off", or empty to keep each operation's setting.
+  Preemptible string
+}
+
+type whatifRow struct {
+  Name string
+  MachineType string
+  NewMachineType string
+  Hours float64
+  Cost money
+  NewCost money
+  Diff money
+  Known bool
+  Fallback bool
+}
+
+func whatifHandler(w http.ResponseWriter, r *http.Request) {
+  ctx := appengine.NewContext(r)
+
+  project, err := getProject(ctx)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  ops, _, err := listOps(ctx, project)
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+
+  filter := parseOpFilter(r)
+  q := r.URL.Query()
+  change := repricing{
+    Machine: q.Get("to_machine"),
+    Region: q.Get("to_region"),
+    Preemptible: q.Get("preemptible"),
+  }
+
+  rows := reprice(filterOps(ops, filter), change, requestCurrency(r))
+  var cost, newCost money
+  for _, row := range rows {
+    if row.Known {
+      cost = cost.Add(row.Cost)
+      newCost = newCost.Add(row.NewCost)
+    }
+  }
+
+  err = render(w, r, whatifTpl, "What-if", struct {
+    Project string
+    Filter opFilter
+    Change repricing
+    Regions []string
+    Rows []whatifRow
+    Cost money
+    NewCost money
+    Diff money
+  }{
+    Project: project,
+    Filter: filter,
+    Change: change,
+    Regions: sortedPriceRegions(),
+    Rows: rows,
+    Cost: cost,
+    NewCost: newCost,
+    Diff: newCost.Sub(cost),
+  })
+  if err != nil {
+    fmt.Fprintln(w, err.Error())
+    return
+  }
+}
+
+// reprice works out what each operation would have cost with the change
+// applied, assuming it would have run for the same time, at the prices
+// in effect when it started. Costs are converted to currency.
+func reprice(ops []tplOp, change repricing, currency string) []whatifRow {
+  var rows []whatifRow
+  for _, op := range convertOps(ops, currency) {
+    if op.Cost.Unknown() {
+      continue
+    }
+    zone, machine := splitMachineType(op.GCE.MachineType)
+    preemptible := strings.HasSuffix(machine, "-preemptible")
+    machine = strings.TrimSuffix(machine, "-preemptible")
+
+    if change.Machine != "" {
+      machine = strings.TrimSuffix(change.Machine, "-preemptible")
+    }
+    if change.Region != "" {
+      // Keep the zone letter, so "us-central1-f" becomes "europe-west1-f".
+      zone = change.Region + strings.TrimPrefix(zone, regionOf(zone))
+    }
+    switch change.Preemptible {
+    case "on":
+      preemptible = true
+    case "off":
+      preemptible = false
+    }
+    if preemptible {
+      machine += "-preemptible"
+    }
+
+    newMachineType := zone + "/" + machine
+    price, ok := catalogAt(op.StartTime).vmPrice(newMachineType)
+    row := whatifRow{
+      Name: op.Name,
+      MachineType: op.GCE.MachineType,
+      NewMachineType: newMachineType,
+      Hours: op.Hours,
+      Cost: op.Cost,
+      NewCost: unknownMoney,
+      Diff: unknownMoney,
+      Known: ok,
+      Fallback: price.Fallback,
+    }
+    if ok {
+      row.NewCost = currencyConf.Rates.convert(price.Hourly, currency, op.StartTime).Mul(op.Hours)
+      row.Diff = row.NewCost.Sub(row.Cost)
+    }
+    rows = append(rows, row)
+  }
+  return rows
+}
+
+var whatifTpl = newPage("whatif")